@@ -9,6 +9,7 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"cogentcore.org/core/colors"
@@ -30,6 +31,7 @@ const (
 
 var (
 	conf       *config.Conf
+	manager    *proxy.Manager
 	mainWindow *core.Body
 	logData    string
 	logText    *core.Text
@@ -45,6 +47,22 @@ func newCustomList(body *core.Body) *CustomList {
 		s.Direction = styles.Column // 垂直布局
 	})
 	customList.Update()
+	customList.done = make(chan struct{})
+	// 定时刷新流量统计
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-customList.done:
+				return
+			case <-ticker.C:
+				customList.Fr.AsyncLock()
+				customList.updateStats()
+				customList.Fr.AsyncUnlock()
+			}
+		}
+	}()
 	return customList
 }
 
@@ -52,9 +70,11 @@ type CustomList struct {
 	data *[]*config.ProxyConfig
 	body *core.Body
 	Fr   *core.Frame
+	done chan struct{}
 }
 
 func (clist *CustomList) Destroy() {
+	close(clist.done)
 	for _, item := range clist.Fr.Children {
 		for _, item1 := range item.AsTree().Children {
 			item1.Destroy()
@@ -75,20 +95,32 @@ func (clist *CustomList) Update() {
 		var row *core.Frame
 		var text *core.Text
 		var statusCv *core.Canvas
+		var healthCv *core.Canvas
+		var stats *core.Text
 		var editBt *core.Button
 		var delBt *core.Button
+		var connsBt *core.Button
+		var captureBt *core.Button
 		if i < len(clist.Fr.Children) {
 			row = clist.Fr.Children[i].(*core.Frame)
 			text = row.Children[0].(*core.Text)
 			statusCv = row.Children[1].(*core.Canvas)
-			editBt = row.Children[2].(*core.Button)
-			delBt = row.Children[3].(*core.Button)
+			healthCv = row.Children[2].(*core.Canvas)
+			stats = row.Children[3].(*core.Text)
+			editBt = row.Children[4].(*core.Button)
+			delBt = row.Children[5].(*core.Button)
+			connsBt = row.Children[6].(*core.Button)
+			captureBt = row.Children[7].(*core.Button)
 		} else {
 			row = core.NewFrame(clist.Fr)
 			text = core.NewText(row)
 			statusCv = core.NewCanvas(row)
+			healthCv = core.NewCanvas(row)
+			stats = core.NewText(row)
 			editBt = core.NewButton(row)
 			delBt = core.NewButton(row)
+			connsBt = core.NewButton(row)
+			captureBt = core.NewButton(row)
 		}
 
 		row.Styler(func(s *styles.Style) {
@@ -98,8 +130,8 @@ func (clist *CustomList) Update() {
 			s.Min.Set(units.Dp(600), units.Dp(20))
 		})
 
-		text.SetText(fmt.Sprintf("0.0.0.0:%d → %s (%s)",
-			item.ListenPort, item.TargetAddr, item.Protocol))
+		text.SetText(fmt.Sprintf("%s → %s (%s)",
+			item.BindAddr(), item.TargetRange(), item.Protocol))
 		statusCv.SetDraw(func(pc *paint.Painter) {
 			pc.Circle(0.5, 0.5, 0.3)
 			if item.Status {
@@ -113,24 +145,109 @@ func (clist *CustomList) Update() {
 		statusCv.Styler(func(s *styles.Style) {
 			s.Min.Set(units.Dp(30), units.Dp(30))
 		})
+		// 目标健康状态
+		healthCv.SetDraw(func(pc *paint.Painter) {
+			pc.Circle(0.5, 0.5, 0.25)
+			pc.Fill.Color = healthColor(manager.Health(item.ID))
+			pc.Draw()
+		})
+		healthCv.Styler(func(s *styles.Style) {
+			s.Min.Set(units.Dp(20), units.Dp(20))
+		})
+		stats.SetText(statsText(item))
 		// 编辑按钮
 		editBt.SetText(config.GetLang("Edit")).OnClick(func(e events.Event) {
 			showEditDialog(item, clist.body, i)
 		})
 		// 删除按钮
 		delBt.SetText(config.GetLang("Delete")).OnClick(func(e events.Event) {
-			if conf.Configs[i].Listener != nil {
-				conf.Configs[i].Listener.Close()
-			}
-			conf.Configs = append(conf.Configs[:i], conf.Configs[i+1:]...)
+			manager.Remove(item.ID)
 			config.SaveConfigs(conf, configFile)
 			clist.Update()
 		})
+		// 连接表按钮
+		connsBt.SetText(config.GetLang("Connections")).OnClick(func(e events.Event) {
+			showConnsDialog(item, clist.body)
+		})
+		// 抓包按钮,文件路径写在日志里
+		captureBt.SetText(captureText(item)).OnClick(func(e events.Event) {
+			if manager.Capturing(item.ID) {
+				manager.StopCapture(item.ID)
+			} else if _, err := manager.StartCapture(item); err != nil {
+				core.ErrorSnackbar(clist.body, err)
+			}
+			captureBt.SetText(captureText(item)).Update()
+		})
 	}
 	clist.Fr.Update()
 	clist.body.Update()
 }
 
+// updateStats 只刷新每行的流量统计
+func (clist *CustomList) updateStats() {
+	for i, item := range *clist.data {
+		if i < len(clist.Fr.Children) {
+			row := clist.Fr.Children[i].(*core.Frame)
+			row.Children[2].(*core.Canvas).NeedsRender()
+			row.Children[3].(*core.Text).SetText(statsText(item))
+			// 抓包达到限制后自动停止
+			row.Children[7].(*core.Button).SetText(captureText(item))
+		}
+	}
+	clist.Fr.Update()
+}
+
+func captureText(cfg *config.ProxyConfig) string {
+	if manager.Capturing(cfg.ID) {
+		return config.GetLang("StopCapture")
+	}
+	return config.GetLang("StartCapture")
+}
+
+// healthColor 目标健康状态的颜色:灰色未检查,绿色全部健康,橙色部分不健康,红色全部不健康
+func healthColor(h proxy.Health) image.Image {
+	switch h {
+	case proxy.HealthUp:
+		return colors.Scheme.Success.Base
+	case proxy.HealthDegraded:
+		return colors.Scheme.Warn.Base
+	case proxy.HealthDown:
+		return colors.Scheme.Error.Base
+	}
+	return colors.Scheme.OutlineVariant
+}
+
+// statsText 列表中显示的规则流量统计
+func statsText(cfg *config.ProxyConfig) string {
+	s := manager.Stats(cfg.ID)
+	return fmt.Sprintf("↑%s ↓%s %s:%d/%d %s:%d %s:%d %s:%d",
+		proxy.FormatBytes(s.BytesIn), proxy.FormatBytes(s.BytesOut),
+		config.GetLang("Conns"), s.ActiveConns, s.TotalConns,
+		config.GetLang("DialFailures"), s.DialFailures,
+		config.GetLang("Denied"), s.Denied,
+		config.GetLang("Limited"), s.Limited)
+}
+
+// 显示规则当前的连接表
+func showConnsDialog(cfg *config.ProxyConfig, b *core.Body) {
+	text := config.GetLang("NoConns")
+	if conns := manager.Conns(cfg.ID); len(conns) > 0 {
+		lines := make([]string, len(conns))
+		for i, c := range conns {
+			lines[i] = c.String()
+		}
+		text = strings.Join(lines, "\n")
+	}
+	// socks5/http-connect规则附带按目标的统计
+	if dests := manager.DestStats(cfg.ID); cfg.Dynamic() && len(dests) > 0 {
+		text += "\n\n" + config.GetLang("DestStats") + ":"
+		for _, d := range dests {
+			text += "\n" + d.String()
+		}
+	}
+	core.MessageDialog(b, text, config.GetLang("Connections"))
+}
+
 func main() {
 	//set icon
 	reader := bytes.NewReader(config.ResourceIconPng)
@@ -138,7 +255,8 @@ func main() {
 	initLog()
 	conf = &config.Conf{}
 	config.LoadConfigs(conf, configFile)
-	proxy.StartPoxy(conf, false)
+	manager = proxy.NewManager(conf)
+	manager.StartAll()
 	ctx, _ := context.WithCancel(context.Background())
 	cmd := config.StartWsl(ctx, conf)
 	if cmd != nil {
@@ -224,16 +342,49 @@ func showEditDialog(cfg *config.ProxyConfig, b *core.Body, index int) {
 	form.SetStruct(cfg)
 	form.Styles.Min.Set(units.Dp(400), units.Dp(600))
 	form.Styles.Max.Set(units.Dp(400), units.Dp(600))
+	// 只有tls协议显示证书指纹,没有配置证书时会生成自签名证书
+	if cfg.Protocol == "tls" {
+		fp, err := proxy.CertFingerprint(cfg)
+		if err != nil {
+			fp = err.Error()
+		}
+		core.NewText(d).SetText(config.GetLang("Fingerprint") + ": " + fp)
+	}
 	d.AddBottomBar(func(bar *core.Frame) {
 		d.AddCancel(bar)
 		d.AddOK(bar).OnClick(func(e events.Event) {
-			if cfg.ListenPort < 1 || cfg.ListenPort > 65535 {
+			if !cfg.ValidPorts() {
 				core.MessageSnackbar(d, config.GetLang("PortErrMsg"))
 				e.SetHandled()
 				return
 			}
+			if !cfg.ValidHealthCheck() {
+				core.MessageSnackbar(d, config.GetLang("HealthErrMsg"))
+				e.SetHandled()
+				return
+			}
+			if !cfg.ValidListenAddr() {
+				core.MessageSnackbar(d, config.GetLang("BindAddrErrMsg"))
+				e.SetHandled()
+				return
+			}
+			if cfg.OpenRelay() {
+				core.MessageSnackbar(d, config.GetLang("RelayErrMsg"))
+				e.SetHandled()
+				return
+			}
+			if !cfg.ValidLimits() {
+				core.MessageSnackbar(d, config.GetLang("LimitErrMsg"))
+				e.SetHandled()
+				return
+			}
+			if !config.ValidIPList(cfg.AllowIPs) || !config.ValidIPList(cfg.DenyIPs) {
+				core.MessageSnackbar(d, config.GetLang("IPListErrMsg"))
+				e.SetHandled()
+				return
+			}
 			for _, v := range conf.Configs {
-				if v.Protocol == cfg.Protocol && v.ListenPort == cfg.ListenPort {
+				if v.Conflicts(cfg) {
 					if v.ID != cfg.ID {
 						core.MessageSnackbar(d, config.GetLang("PortErrUsed"))
 						e.SetHandled()
@@ -241,13 +392,18 @@ func showEditDialog(cfg *config.ProxyConfig, b *core.Body, index int) {
 					}
 				}
 			}
-			cfg.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+			var err error
 			if index == -1 {
-				conf.Configs = append(conf.Configs, cfg)
+				cfg.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+				err = manager.Add(cfg)
+			} else {
+				err = manager.Restart(cfg)
 			}
 			config.SaveConfigs(conf, configFile)
-			proxy.StartPoxy(conf, true)
 			configList.Update()
+			if err != nil {
+				core.ErrorSnackbar(b, err)
+			}
 		})
 	})
 	d.OnClose(func(e events.Event) {
@@ -267,6 +423,7 @@ func showGlobalSettings(b *core.Body) {
 	d.AddBottomBar(func(bar *core.Frame) {
 		d.AddCancel(bar)
 		d.AddOK(bar).OnClick(func(e events.Event) {
+			manager.SetGlobal(conf)
 			config.SaveConfigs(conf, configFile)
 		})
 	})
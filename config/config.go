@@ -4,11 +4,14 @@ import (
 	"context"
 	_ "embed"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -18,13 +21,64 @@ import (
 var currentLang = "en"
 
 type ProxyConfig struct {
-	ID         string       `display:"-" json:"id"`
-	Protocol   string       `json:"protocol" label:"Protocol:"`
-	ListenPort int          `json:"listenPort"`
-	TargetAddr string       `json:"targetAddr"`
-	Listener   net.Listener `json:"-" display:"-"`
-	UdpConn    *net.UDPConn `json:"-" display:"-"`
-	Status     bool         `json:"-" display:"-"`
+	ID             string   `display:"-" json:"id"`
+	Protocol       string   `json:"protocol" label:"Protocol:"`
+	ListenAddr     string   `json:"listenAddr,omitempty"` // 监听IP,空为0.0.0.0,dual为IPv4/IPv6双栈
+	ListenPort     int      `json:"listenPort"`
+	ListenPortEnd  int      `json:"listenPortEnd,omitempty"` // 端口范围的结束端口,0为单端口;范围内的端口一一对应到目标端口
+	TargetAddr     string   `json:"targetAddr"`
+	Targets        []string `json:"targets,omitempty"`   // 额外的目标地址,和TargetAddr一起负载均衡
+	Balance        string   `json:"balance,omitempty"`   // 负载均衡策略,空为round-robin
+	Routes         []Route  `json:"routes,omitempty"`    // sni/http协议按主机名选择目标,没有匹配时使用TargetAddr
+	AllowDest      []string `json:"allowDest,omitempty"` // socks5/http-connect协议允许的目标: CIDR、IP或主机名(支持*.example.com),为空时不限制
+	ProxyUser      string   `json:"proxyUser,omitempty"` // socks5/http-connect协议的用户名密码,为空时不需要认证
+	ProxyPass      string   `json:"proxyPass,omitempty"`
+	AllowIPs       []string `json:"allowIPs,omitempty"`       // 允许连接的客户端CIDR/IP,为空时允许所有;和DenyIPs都为空时使用全局设置
+	DenyIPs        []string `json:"denyIPs,omitempty"`        // 拒绝连接的客户端CIDR/IP,优先于AllowIPs
+	MaxSessions    int      `json:"maxSessions,omitempty"`    // UDP最大会话数,0为默认值1024
+	MaxConns       int      `json:"maxConns,omitempty"`       // TCP最大并发连接数,0为不限制
+	MaxConnsPerIP  int      `json:"maxConnsPerIP,omitempty"`  // 每个客户端IP的最大并发连接数,0为不限制,超过时总是拒绝
+	AcceptRate     int      `json:"acceptRate,omitempty"`     // 每秒接受的TCP连接数,0为不限制
+	AcceptBurst    int      `json:"acceptBurst,omitempty"`    // 接受速率的突发数,0为等于AcceptRate
+	QueueConns     bool     `json:"queueConns,omitempty"`     // 超过连接数或速率限制时排队等待,否则拒绝
+	UploadRate     int      `json:"uploadRate,omitempty"`     // 规则的上传(客户端->目标)限速KB/s,0为不限制
+	DownloadRate   int      `json:"downloadRate,omitempty"`   // 规则的下载(目标->客户端)限速KB/s,0为不限制
+	ConnRate       int      `json:"connRate,omitempty"`       // 每条连接每个方向的限速KB/s,0为不限制;UDP超速的报文丢弃
+	CaptureMB      int      `json:"captureMB,omitempty"`      // 抓包文件的最大MB,0为默认100
+	CaptureSeconds int      `json:"captureSeconds,omitempty"` // 抓包的最长秒数,0为默认600
+	DebugBytes     int      `json:"debugBytes,omitempty"`     // 调试日志记录每条连接每个方向的前N字节,0为关闭
+	DebugText      bool     `json:"debugText,omitempty"`      // 调试日志输出可打印文本,否则为hexdump
+	SendProxy      string   `json:"sendProxy,omitempty"`      // 向目标发送PROXY protocol头: v1/v2,UDP总是v2;UDP监听通配地址时目标地址取回复客户端的源地址
+	AcceptProxy    bool     `json:"acceptProxy,omitempty"`    // TCP监听接收客户端发来的PROXY protocol头
+	TLSCert        string   `json:"tlsCert,omitempty"`        // tls协议的证书文件,和TLSKey都为空时使用自动生成的自签名证书
+	TLSKey         string   `json:"tlsKey,omitempty"`
+	Status         bool     `json:"-" display:"-"`
+	// 用TLS连接目标
+	TargetTLS        bool   `json:"targetTls,omitempty"`
+	TargetServerName string `json:"targetServerName,omitempty"` // 为空时使用目标地址的主机名
+	TargetCA         string `json:"targetCa,omitempty"`         // 验证目标证书的CA文件,为空时使用系统CA
+	TargetInsecure   bool   `json:"targetInsecure,omitempty"`   // 不验证目标证书,只用于开发环境
+	TargetClientCert string `json:"targetClientCert,omitempty"` // 客户端证书文件
+	TargetClientKey  string `json:"targetClientKey,omitempty"`
+	// 超时(秒),0为使用全局设置,负数为不超时
+	TCPTimeout   int `json:"tcpTimeout,omitempty"`
+	UDPTimeout   int `json:"udpTimeout,omitempty"`
+	DialTimeout  int `json:"dialTimeout,omitempty"`
+	WriteTimeout int `json:"writeTimeout,omitempty"` // 对端一直不读数据时写入的超时
+	// 健康检查,HealthCheck为空时不检查
+	HealthCheck    string `json:"healthCheck,omitempty"`    // tcp/udp/http
+	HealthInterval int    `json:"healthInterval,omitempty"` // 检查间隔(秒),0为默认10秒
+	HealthSend     string `json:"healthSend,omitempty"`     // UDP请求内容(支持\x00转义)或HTTP路径
+	HealthExpect   string `json:"healthExpect,omitempty"`   // UDP期望响应包含的内容或HTTP期望状态码
+}
+
+// Route 按主机名路由到目标,Host可以是 *.example.com 这样的通配,为空时匹配所有主机名;
+// http协议还可以按路径前缀路由,StripPrefix为true时转发前去掉前缀
+type Route struct {
+	Host        string `json:"host"`
+	Path        string `json:"path,omitempty"`
+	Target      string `json:"target"`
+	StripPrefix bool   `json:"stripPrefix,omitempty"`
 }
 
 type Conf struct {
@@ -34,22 +88,313 @@ type Conf struct {
 	ShowWsl      bool           `json:"showWsl"`
 	HideWindow   bool           `json:"HideWindow"`
 	AutoUseWslIp bool           `json:"AutoGetWslIp"`
+	// 全局默认超时(秒),0为内置默认值,负数为不超时
+	TCPTimeout   int `json:"tcpTimeout,omitempty"`
+	UDPTimeout   int `json:"udpTimeout,omitempty"`
+	DialTimeout  int `json:"dialTimeout,omitempty"`
+	WriteTimeout int `json:"writeTimeout,omitempty"` // 对端一直不读数据时写入的超时
+	// 规则没有设置客户端IP列表时使用的全局列表
+	AllowIPs []string `json:"allowIPs,omitempty"`
+	DenyIPs  []string `json:"denyIPs,omitempty"`
+}
+
+// Protocols 支持的协议,tls在监听端解密后以明文转发给目标,sni按TLS握手中的主机名路由且不解密,
+// http是按Host头路由的反向代理,socks5和http-connect由客户端指定目标
+var Protocols = []string{"tcp", "udp", "tls", "sni", "http", "socks5", "http-connect"}
+
+// Dynamic 目标由客户端指定的协议,不使用TargetAddr
+func (c *ProxyConfig) Dynamic() bool {
+	return c.Protocol == "socks5" || c.Protocol == "http-connect"
+}
+
+// Transport 监听使用的传输层协议,除udp外都是tcp
+func (c *ProxyConfig) Transport() string {
+	if c.Protocol == "udp" {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// DualStack 同时监听IPv4和IPv6
+const DualStack = "dual"
+
+// 负载均衡策略
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn  = "least-conn"
+	BalanceRandom     = "random"
+	BalanceSourceHash = "source-hash"
+)
+
+var Balances = []string{BalanceRoundRobin, BalanceLeastConn, BalanceRandom, BalanceSourceHash}
+
+// 发送给目标的PROXY protocol版本
+const (
+	ProxyV1 = "v1"
+	ProxyV2 = "v2"
+)
+
+var ProxyProtocols = []string{"", ProxyV1, ProxyV2}
+
+// 健康检查方式
+const (
+	HealthTCP  = "tcp"
+	HealthUDP  = "udp"
+	HealthHTTP = "http"
+)
+
+var HealthChecks = []string{"", HealthTCP, HealthUDP, HealthHTTP}
+
+// ValidIPList 每项都要是CIDR或IP
+func ValidIPList(list []string) bool {
+	for _, v := range list {
+		if _, _, err := net.ParseCIDR(v); err != nil && net.ParseIP(v) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// OpenRelay socks5/http-connect规则没有认证、没有目标允许列表又不是只监听本机时,
+// 任何能连上的客户端都可以借它访问任意目标,这样的规则不允许启动
+func (c *ProxyConfig) OpenRelay() bool {
+	if !c.Dynamic() || c.ProxyUser != "" || len(c.AllowDest) > 0 {
+		return false
+	}
+	ip := net.ParseIP(c.ListenHost())
+	return ip == nil || !ip.IsLoopback()
+}
+
+// ValidLimits 连接限制、限速和抓包等数量设置不能是负数
+func (c *ProxyConfig) ValidLimits() bool {
+	return c.MaxSessions >= 0 && c.MaxConns >= 0 && c.MaxConnsPerIP >= 0 && c.AcceptRate >= 0 && c.AcceptBurst >= 0 &&
+		c.UploadRate >= 0 && c.DownloadRate >= 0 && c.ConnRate >= 0 &&
+		c.CaptureMB >= 0 && c.CaptureSeconds >= 0 && c.DebugBytes >= 0
+}
+
+// ValidHealthCheck 检查方式要是已知的,HTTP的期望状态码要是数字
+func (c *ProxyConfig) ValidHealthCheck() bool {
+	switch c.HealthCheck {
+	case "", HealthTCP, HealthUDP:
+	case HealthHTTP:
+		if c.HealthExpect != "" {
+			code, err := strconv.Atoi(c.HealthExpect)
+			if err != nil || code < 100 || code > 599 {
+				return false
+			}
+		}
+	default:
+		return false
+	}
+	return c.HealthInterval >= 0
+}
+
+// Clone 深拷贝配置,切片不和原配置共用,界面修改原配置不影响拷贝
+func (c *ProxyConfig) Clone() *ProxyConfig {
+	n := *c
+	n.Targets = slices.Clone(c.Targets)
+	n.Routes = slices.Clone(c.Routes)
+	n.AllowDest = slices.Clone(c.AllowDest)
+	n.AllowIPs = slices.Clone(c.AllowIPs)
+	n.DenyIPs = slices.Clone(c.DenyIPs)
+	return &n
+}
+
+// TargetList 返回全部目标地址,TargetAddr在第一个;目标由客户端指定的协议返回nil
+func (c *ProxyConfig) TargetList() []string {
+	if c.Dynamic() {
+		return nil
+	}
+	list := []string{c.TargetAddr}
+	for _, v := range c.Targets {
+		if v = strings.TrimSpace(v); v != "" && v != c.TargetAddr {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// ListenHost 返回规范化的监听IP,空为0.0.0.0
+func (c *ProxyConfig) ListenHost() string {
+	host := strings.Trim(strings.TrimSpace(c.ListenAddr), "[]")
+	if host == "" {
+		return "0.0.0.0"
+	}
+	return host
+}
+
+// BindAddr 列表中显示的实际监听地址,双栈显示为 *:端口
+func (c *ProxyConfig) BindAddr() string {
+	host := c.ListenHost()
+	if host == DualStack {
+		return "*:" + c.PortRange()
+	}
+	return net.JoinHostPort(host, c.PortRange())
+}
+
+// LastPort 端口范围的最后一个端口,单端口时等于ListenPort
+func (c *ProxyConfig) LastPort() int {
+	if c.ListenPortEnd > c.ListenPort {
+		return c.ListenPortEnd
+	}
+	return c.ListenPort
+}
+
+// PortCount 监听的端口数量
+func (c *ProxyConfig) PortCount() int {
+	return c.LastPort() - c.ListenPort + 1
+}
+
+// PortRange 显示用的端口,如 8080 或 3000-3010
+func (c *ProxyConfig) PortRange() string {
+	if c.PortCount() > 1 {
+		return fmt.Sprintf("%d-%d", c.ListenPort, c.LastPort())
+	}
+	return strconv.Itoa(c.ListenPort)
+}
+
+// TargetRange 显示用的目标地址,端口范围时显示目标端口范围,多个目标时显示目标数量
+func (c *ProxyConfig) TargetRange() string {
+	if c.Dynamic() {
+		return "*"
+	}
+	target := c.TargetAddr
+	host, port, err := net.SplitHostPort(c.TargetAddr)
+	n, err2 := strconv.Atoi(port)
+	if c.PortCount() > 1 && err == nil && err2 == nil {
+		target = net.JoinHostPort(host, fmt.Sprintf("%d-%d", n, n+c.PortCount()-1))
+	}
+	if extra := len(c.TargetList()) - 1; extra > 0 {
+		target += fmt.Sprintf(" (+%d)", extra)
+	}
+	return target
+}
+
+// ParsePortRange 解析 8080 或 3000-3010 这样的端口
+func ParsePortRange(text string) (start, end int, err error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(text), "-")
+	start, err = strconv.Atoi(strings.TrimSpace(first))
+	if err != nil || !isRange {
+		return start, 0, err
+	}
+	end, err = strconv.Atoi(strings.TrimSpace(last))
+	return start, end, err
+}
+
+// ValidPorts 监听端口和对应的目标端口都要在1-65535之内
+func (c *ProxyConfig) ValidPorts() bool {
+	if c.ListenPort < 1 || c.LastPort() > 65535 {
+		return false
+	}
+	if c.ListenPortEnd != 0 && c.ListenPortEnd < c.ListenPort {
+		return false
+	}
+	if c.Dynamic() {
+		return true
+	}
+	targets := c.TargetList()
+	for _, route := range c.Routes {
+		targets = append(targets, route.Target)
+	}
+	for _, target := range targets {
+		_, port, err := net.SplitHostPort(target)
+		if err != nil {
+			if c.PortCount() > 1 {
+				return false
+			}
+			continue // 目标地址格式错误留到连接时报错
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n+c.PortCount()-1 > 65535 {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseRoutes 解析每行一个的路由表,格式为 host/path=target,
+// host和/path可以省略其一,末尾加 strip 表示转发前去掉路径前缀
+func ParseRoutes(text string) ([]Route, error) {
+	var routes []Route
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		match, target, ok := strings.Cut(line, "=")
+		match = strings.TrimSpace(match)
+		fields := strings.Fields(target)
+		if !ok || match == "" || len(fields) == 0 || len(fields) > 2 || (len(fields) == 2 && fields[1] != "strip") {
+			return nil, fmt.Errorf("invalid route %q", line)
+		}
+		route := Route{Host: match, Target: fields[0], StripPrefix: len(fields) == 2}
+		if i := strings.Index(match, "/"); i >= 0 {
+			route.Host, route.Path = match[:i], match[i:]
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// FormatRoutes 把路由表格式化成ParseRoutes的格式
+func FormatRoutes(routes []Route) string {
+	lines := make([]string, len(routes))
+	for i, r := range routes {
+		lines[i] = r.Host + r.Path + "=" + r.Target
+		if r.StripPrefix {
+			lines[i] += " strip"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidListenAddr 监听地址只能是IP或dual
+func (c *ProxyConfig) ValidListenAddr() bool {
+	host := c.ListenHost()
+	return host == DualStack || net.ParseIP(host) != nil
+}
+
+// Conflicts 判断两条规则是否监听了同一个地址和端口,端口范围有重叠也算冲突
+func (c *ProxyConfig) Conflicts(o *ProxyConfig) bool {
+	if c.Transport() != o.Transport() || c.ListenPort > o.LastPort() || o.ListenPort > c.LastPort() {
+		return false
+	}
+	return hostsOverlap(c.ListenHost(), o.ListenHost())
+}
+
+// hostsOverlap 通配地址和同协议族的任意地址重叠,双栈和所有地址重叠
+func hostsOverlap(a, b string) bool {
+	if a == b || a == DualStack || b == DualStack {
+		return true
+	}
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return false
+	}
+	if ipA.Equal(ipB) {
+		return true
+	}
+	if (ipA.To4() != nil) != (ipB.To4() != nil) {
+		return false
+	}
+	return ipA.IsUnspecified() || ipB.IsUnspecified()
 }
 
 func SaveConfigs(conf *Conf, configFile string) {
-	path := filepath.Join(appDataDir(), configFile)
+	path := filepath.Join(AppDataDir(), configFile)
 	data, _ := json.MarshalIndent(conf, "", "  ")
 	os.MkdirAll(filepath.Dir(path), 0755)
 	os.WriteFile(path, data, 0644)
 }
 
 func LoadConfigs(conf *Conf, configFile string) {
-	path := filepath.Join(appDataDir(), configFile)
+	path := filepath.Join(AppDataDir(), configFile)
 	data, _ := os.ReadFile(path)
 	json.Unmarshal(data, &conf)
 }
 
-func appDataDir() string {
+// AppDataDir 应用配置目录
+func AppDataDir() string {
 	dir, _ := os.UserConfigDir()
 	return filepath.Join(dir, "wslPortForward")
 }
@@ -71,13 +416,71 @@ var langMap = map[string]map[string]string{
 		"TargetAddr":     "Target Addr",
 		"Save":           "Save",
 		"Cancel":         "Cancel",
-		"PortErrMsg":     "The port can only be 1-65535",
+		"PortErrMsg":     "The port can only be 1-65535, ranges like 3000-3010",
 		"PortErrUsed":    "Port is used",
 		"WslStart":       "Start WSL",
 		"WslShow":        "Show WSL Window",
 		"WslArgs":        "WSL Start Args",
 		"HideWindow":     "Hide Window",
 		"AutoUseWslIp":   "Auto Use WSL Ip",
+		"Connections":    "Connections",
+		"Conns":          "conns",
+		"DialFailures":   "dial failures",
+		"NoConns":        "No active connections",
+		"Close":          "Close",
+		"MaxSessions":    "Max UDP Sessions",
+		"TCPTimeout":     "TCP Idle Timeout (s)",
+		"UDPTimeout":     "UDP Idle Timeout (s)",
+		"DialTimeout":    "Dial Timeout (s)",
+		"WriteTimeout":   "Write Stall Timeout (s)",
+		"TimeoutErrMsg":  "Timeout must be a number of seconds",
+		"BindAddr":       "Bind Address",
+		"BindAddrErrMsg": "Bind address must be an IP or dual",
+		"Targets":        "More Targets (one per line)",
+		"Balance":        "Load Balancing",
+		"HealthCheck":    "Health Check",
+		"HealthInterval": "Check Interval (s)",
+		"HealthSend":     "UDP Request / HTTP Path",
+		"HealthExpect":   "Expected Response / Status",
+		"HealthErrMsg":   "Invalid health check settings",
+		"SendProxy":      "Send PROXY Protocol",
+		"AcceptProxy":    "Accept PROXY Protocol",
+		"TLSCert":        "TLS Cert File",
+		"TLSKey":         "TLS Key File",
+		"Fingerprint":    "Cert Fingerprint (SHA-256)",
+		"TargetTLS":      "Connect Target via TLS",
+		"TargetSNI":      "Target Server Name",
+		"TargetCA":       "Target CA File",
+		"TargetInsecure": "Skip Target Cert Verify",
+		"ClientCert":     "Client Cert File",
+		"ClientKey":      "Client Key File",
+		"Routes":         "Routes (host/path=target [strip] per line)",
+		"RouteErrMsg":    "Each route must be host/path=target, optionally followed by strip",
+		"AllowDest":      "Allowed Destinations (CIDR/IP/host per line)",
+		"ProxyUser":      "Proxy Username",
+		"ProxyPass":      "Proxy Password",
+		"DestStats":      "By Destination",
+		"AllowIPs":       "Allowed Clients (CIDR/IP per line)",
+		"DenyIPs":        "Denied Clients (CIDR/IP per line)",
+		"IPListErrMsg":   "Client IP lists must contain only CIDRs or IPs",
+		"RelayErrMsg":    "A socks5/http-connect rule without a username or allowed destinations must listen on 127.0.0.1 or ::1",
+		"Denied":         "denied",
+		"MaxConns":       "Max Connections (0 = unlimited)",
+		"MaxConnsPerIP":  "Max Connections per IP",
+		"AcceptRate":     "Accept Rate (conns/s)",
+		"AcceptBurst":    "Accept Burst",
+		"QueueConns":     "Queue Over-limit Connections",
+		"LimitErrMsg":    "Limits must be non-negative numbers",
+		"Limited":        "limited",
+		"UploadRate":     "Upload Limit (KB/s, 0 = unlimited)",
+		"DownloadRate":   "Download Limit (KB/s)",
+		"ConnRate":       "Per-connection Limit (KB/s)",
+		"CaptureMB":      "Capture Size Limit (MB, 0 = 100)",
+		"CaptureSeconds": "Capture Time Limit (s, 0 = 600)",
+		"StartCapture":   "Capture",
+		"StopCapture":    "Stop Capture",
+		"DebugBytes":     "Debug Log First N Bytes (0 = off)",
+		"DebugText":      "Debug Log as Text",
 	},
 	"zh": {
 		"Quit":           "退出",
@@ -95,13 +498,71 @@ var langMap = map[string]map[string]string{
 		"TargetAddr":     "目标地址",
 		"Save":           "保存",
 		"Cancel":         "取消",
-		"PortErrMsg":     "端口号只能1-65535",
+		"PortErrMsg":     "端口号只能1-65535,范围如3000-3010",
 		"PortErrUsed":    "端口已被使用",
 		"WslStart":       "启动WSL",
 		"WslShow":        "显示WSL窗口",
 		"WslArgs":        "WSL启动参数",
 		"HideWindow":     "隐藏窗口",
 		"AutoUseWslIp":   "自动使用WSL IP",
+		"Connections":    "连接",
+		"Conns":          "连接",
+		"DialFailures":   "连接失败",
+		"NoConns":        "无活动连接",
+		"Close":          "关闭",
+		"MaxSessions":    "UDP最大会话数",
+		"TCPTimeout":     "TCP空闲超时(秒)",
+		"UDPTimeout":     "UDP空闲超时(秒)",
+		"DialTimeout":    "连接超时(秒)",
+		"WriteTimeout":   "写入阻塞超时(秒)",
+		"TimeoutErrMsg":  "超时只能填写秒数",
+		"BindAddr":       "监听IP",
+		"BindAddrErrMsg": "监听IP只能填写IP或dual",
+		"Targets":        "更多目标地址(每行一个)",
+		"Balance":        "负载均衡",
+		"HealthCheck":    "健康检查",
+		"HealthInterval": "检查间隔(秒)",
+		"HealthSend":     "UDP请求/HTTP路径",
+		"HealthExpect":   "期望响应/状态码",
+		"HealthErrMsg":   "健康检查设置不正确",
+		"SendProxy":      "发送PROXY协议头",
+		"AcceptProxy":    "接收PROXY协议头",
+		"TLSCert":        "TLS证书文件",
+		"TLSKey":         "TLS私钥文件",
+		"Fingerprint":    "证书指纹(SHA-256)",
+		"TargetTLS":      "用TLS连接目标",
+		"TargetSNI":      "目标服务器名",
+		"TargetCA":       "目标CA文件",
+		"TargetInsecure": "不验证目标证书",
+		"ClientCert":     "客户端证书文件",
+		"ClientKey":      "客户端私钥文件",
+		"Routes":         "路由(每行一个 主机名/路径=目标 [strip])",
+		"RouteErrMsg":    "路由格式为 主机名/路径=目标,末尾可加strip",
+		"AllowDest":      "允许的目标(每行一个 CIDR/IP/主机名)",
+		"ProxyUser":      "代理用户名",
+		"ProxyPass":      "代理密码",
+		"DestStats":      "按目标统计",
+		"AllowIPs":       "允许的客户端(每行一个 CIDR/IP)",
+		"DenyIPs":        "拒绝的客户端(每行一个 CIDR/IP)",
+		"IPListErrMsg":   "客户端IP列表只能填写CIDR或IP",
+		"RelayErrMsg":    "没有设置用户名和允许的目标的socks5/http-connect规则只能监听127.0.0.1或::1",
+		"Denied":         "拒绝",
+		"MaxConns":       "最大连接数(0为不限制)",
+		"MaxConnsPerIP":  "每个IP最大连接数",
+		"AcceptRate":     "接受速率(连接/秒)",
+		"AcceptBurst":    "接受突发数",
+		"QueueConns":     "超过限制时排队",
+		"LimitErrMsg":    "限制只能填写非负数",
+		"Limited":        "限流",
+		"UploadRate":     "上传限速(KB/s,0为不限制)",
+		"DownloadRate":   "下载限速(KB/s)",
+		"ConnRate":       "每条连接限速(KB/s)",
+		"CaptureMB":      "抓包文件大小上限(MB,0为100)",
+		"CaptureSeconds": "抓包时长上限(秒,0为600)",
+		"StartCapture":   "抓包",
+		"StopCapture":    "停止抓包",
+		"DebugBytes":     "调试日志记录前N字节(0为关闭)",
+		"DebugText":      "调试日志显示为文本",
 	},
 }
 
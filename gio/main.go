@@ -7,6 +7,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"gioui.org/app"
 	"gioui.org/layout"
@@ -21,6 +22,7 @@ import (
 
 type UIState struct {
 	conf          *config.Conf
+	manager       *proxy.Manager
 	th            *material.Theme
 	wslCommand    widget.Editor
 	showAddDialog bool
@@ -54,7 +56,14 @@ func main() {
 		w := new(app.Window)
 		w.Option(app.Title(config.GetLang("AppName")))
 		ui.initLog()
-		proxy.StartPoxy(ui.conf, false)
+		ui.manager = proxy.NewManager(ui.conf)
+		ui.manager.StartAll()
+		// 定时刷新流量统计
+		go func() {
+			for range time.Tick(time.Second) {
+				w.Invalidate()
+			}
+		}()
 		if err := ui.Loop(w); err != nil {
 			log.Fatal(err)
 		}
@@ -128,14 +137,46 @@ func (ui *UIState) renderConfigList(gtx layout.Context) layout.Dimensions {
 					return layout.Dimensions{Size: gtx.Constraints.Max}
 				})
 			}),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				return widget.Border{
+					Color: healthColor(ui.manager.Health(cfg.ID)),
+					Width: unit.Dp(2),
+				}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+					return layout.Dimensions{Size: gtx.Constraints.Max}
+				})
+			}),
 			layout.Rigid(material.Label(ui.th, unit.Sp(14),
-				fmt.Sprintf("%d → %s (%s)", cfg.ListenPort, cfg.TargetAddr, cfg.Protocol)).Layout),
+				fmt.Sprintf("%s → %s (%s)", cfg.BindAddr(), cfg.TargetRange(), cfg.Protocol)).Layout),
+			layout.Rigid(material.Label(ui.th, unit.Sp(12), ui.statsText(cfg)).Layout),
 			layout.Rigid(material.Button(ui.th, &ui.editBtns[i], config.GetLang("Edit")).Layout),
 			layout.Rigid(material.Button(ui.th, &ui.deleteBtns[i], config.GetLang("Delete")).Layout),
 		)
 	})
 }
 
+// healthColor 目标健康状态的颜色:灰色未检查,绿色全部健康,橙色部分不健康,红色全部不健康
+func healthColor(h proxy.Health) color.NRGBA {
+	switch h {
+	case proxy.HealthUp:
+		return color.NRGBA{G: 200, A: 255}
+	case proxy.HealthDegraded:
+		return color.NRGBA{R: 255, G: 165, A: 255}
+	case proxy.HealthDown:
+		return color.NRGBA{R: 255, A: 255}
+	}
+	return color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+}
+
+func (ui *UIState) statsText(cfg *config.ProxyConfig) string {
+	s := ui.manager.Stats(cfg.ID)
+	return fmt.Sprintf(" ↑%s ↓%s %s:%d/%d %s:%d %s:%d %s:%d ",
+		proxy.FormatBytes(s.BytesIn), proxy.FormatBytes(s.BytesOut),
+		config.GetLang("Conns"), s.ActiveConns, s.TotalConns,
+		config.GetLang("DialFailures"), s.DialFailures,
+		config.GetLang("Denied"), s.Denied,
+		config.GetLang("Limited"), s.Limited)
+}
+
 func (ui *UIState) renderAddDialog(gtx layout.Context) layout.Dimensions {
 	// 实现类似原showConfigDialog的功能
 	// 使用Gio的输入组件构建表单
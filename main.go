@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -29,6 +30,7 @@ const (
 // 在全局变量区添加完整声明
 var (
 	conf       *config.Conf
+	manager    *proxy.Manager
 	configList *widget.List
 	mainWindow fyne.Window
 	logData    *widget.TextGrid
@@ -45,8 +47,15 @@ func main() {
 	mainWindow = myApp.NewWindow(config.GetLang("AppName"))
 	mainWindow.SetIcon(fyne.NewStaticResource("icon", config.ResourceIconPng))
 	mainWindow.SetCloseIntercept(func() { mainWindow.Hide() }) // 点击关闭隐藏窗口
-	proxy.StartPoxy(conf, false)
+	manager = proxy.NewManager(conf)
+	manager.StartAll()
 	buildUI()
+	// 定时刷新列表中的流量统计
+	go func() {
+		for range time.Tick(time.Second) {
+			fyne.Do(configList.Refresh)
+		}
+	}()
 	ctx, _ := context.WithCancel(context.Background())
 	cmd := config.StartWsl(ctx, conf)
 	if cmd != nil {
@@ -83,8 +92,15 @@ func buildUI() {
 					fyne.NewSize(20, 20), // 设置圆形直径
 					canvas.NewCircle(color.RGBA{R: 255, A: 255}),
 				)),
+				container.NewCenter(container.NewGridWrap(
+					fyne.NewSize(12, 12), // 目标健康状态
+					canvas.NewCircle(healthColor(proxy.HealthUnknown)),
+				)),
+				widget.NewLabel(""),
 				widget.NewButton(config.GetLang("Edit"), nil),
 				widget.NewButton(config.GetLang("Delete"), nil),
+				widget.NewButton(config.GetLang("Connections"), nil),
+				widget.NewButton(config.GetLang("StartCapture"), nil),
 			)
 		},
 		func(id widget.ListItemID, obj fyne.CanvasObject) {
@@ -92,8 +108,8 @@ func buildUI() {
 			cfg := conf.Configs[id]
 
 			label := box.Objects[0].(*widget.Label)
-			label.SetText(fmt.Sprintf("0.0.0.0:%d → %s (%s)",
-				cfg.ListenPort, cfg.TargetAddr, cfg.Protocol))
+			label.SetText(fmt.Sprintf("%s → %s (%s)",
+				cfg.BindAddr(), cfg.TargetRange(), cfg.Protocol))
 
 			statusLabel := box.Objects[1].(*fyne.Container).Objects[0].(*fyne.Container).Objects[0].(*canvas.Circle)
 			if cfg.Status {
@@ -101,11 +117,30 @@ func buildUI() {
 			} else {
 				statusLabel.FillColor = color.RGBA{R: 255, G: 0, B: 00, A: 255}
 			}
-			editBtn := box.Objects[2].(*widget.Button)
+			healthCircle := box.Objects[2].(*fyne.Container).Objects[0].(*fyne.Container).Objects[0].(*canvas.Circle)
+			healthCircle.FillColor = healthColor(manager.Health(cfg.ID))
+			healthCircle.Refresh()
+
+			statsLabel := box.Objects[3].(*widget.Label)
+			statsLabel.SetText(statsText(cfg))
+
+			editBtn := box.Objects[4].(*widget.Button)
 			editBtn.OnTapped = func() { showEditDialog(cfg) }
 
-			delBtn := box.Objects[3].(*widget.Button)
+			delBtn := box.Objects[5].(*widget.Button)
 			delBtn.OnTapped = func() { deleteConfig(cfg) }
+
+			connsBtn := box.Objects[6].(*widget.Button)
+			connsBtn.OnTapped = func() { showConnsDialog(cfg) }
+
+			// 抓包达到大小或时长限制后自动停止,按钮随列表刷新
+			captureBtn := box.Objects[7].(*widget.Button)
+			if manager.Capturing(cfg.ID) {
+				captureBtn.SetText(config.GetLang("StopCapture"))
+			} else {
+				captureBtn.SetText(config.GetLang("StartCapture"))
+			}
+			captureBtn.OnTapped = func() { toggleCapture(cfg) }
 		},
 	)
 
@@ -138,16 +173,64 @@ func buildUI() {
 	))
 }
 
-func deleteConfig(cfg *config.ProxyConfig) {
-	for i, c := range conf.Configs {
-		if c.ID == cfg.ID {
-			conf.Configs = append(conf.Configs[:i], conf.Configs[i+1:]...)
-			if cfg.Listener != nil {
-				cfg.Listener.Close()
-			}
-			break
+// healthColor 目标健康状态的颜色:灰色未检查,绿色全部健康,橙色部分不健康,红色全部不健康
+func healthColor(h proxy.Health) color.Color {
+	switch h {
+	case proxy.HealthUp:
+		return color.RGBA{G: 200, A: 255}
+	case proxy.HealthDegraded:
+		return color.RGBA{R: 255, G: 165, A: 255}
+	case proxy.HealthDown:
+		return color.RGBA{R: 255, A: 255}
+	}
+	return color.RGBA{R: 128, G: 128, B: 128, A: 255}
+}
+
+// statsText 列表中显示的规则流量统计
+func statsText(cfg *config.ProxyConfig) string {
+	s := manager.Stats(cfg.ID)
+	return fmt.Sprintf("↑%s ↓%s %s:%d/%d %s:%d %s:%d %s:%d",
+		proxy.FormatBytes(s.BytesIn), proxy.FormatBytes(s.BytesOut),
+		config.GetLang("Conns"), s.ActiveConns, s.TotalConns,
+		config.GetLang("DialFailures"), s.DialFailures,
+		config.GetLang("Denied"), s.Denied,
+		config.GetLang("Limited"), s.Limited)
+}
+
+// 显示规则当前的连接表
+func showConnsDialog(cfg *config.ProxyConfig) {
+	text := config.GetLang("NoConns")
+	if conns := manager.Conns(cfg.ID); len(conns) > 0 {
+		lines := make([]string, len(conns))
+		for i, c := range conns {
+			lines[i] = c.String()
 		}
+		text = strings.Join(lines, "\n")
 	}
+	// socks5/http-connect规则附带按目标的统计
+	if dests := manager.DestStats(cfg.ID); cfg.Dynamic() && len(dests) > 0 {
+		text += "\n\n" + config.GetLang("DestStats") + ":"
+		for _, d := range dests {
+			text += "\n" + d.String()
+		}
+	}
+	connsScroll := container.NewScroll(widget.NewTextGridFromString(text))
+	connsScroll.SetMinSize(fyne.NewSize(600, 300))
+	dialog.ShowCustom(config.GetLang("Connections"), config.GetLang("Close"), connsScroll, mainWindow)
+}
+
+// toggleCapture 开始或停止规则的抓包,文件路径写在日志里
+func toggleCapture(cfg *config.ProxyConfig) {
+	if manager.Capturing(cfg.ID) {
+		manager.StopCapture(cfg.ID)
+	} else if _, err := manager.StartCapture(cfg); err != nil {
+		dialog.ShowError(err, mainWindow)
+	}
+	configList.Refresh()
+}
+
+func deleteConfig(cfg *config.ProxyConfig) {
+	manager.Remove(cfg.ID)
 	config.SaveConfigs(conf, configFile)
 	configList.Refresh()
 }
@@ -158,52 +241,215 @@ func showAddDialog() {
 		TargetAddr: "127.0.0.1:8080",
 	}, func(cfg *config.ProxyConfig) {
 		cfg.ID = fmt.Sprintf("%d", time.Now().UnixNano())
-		conf.Configs = append(conf.Configs, cfg)
+		err := manager.Add(cfg)
 		config.SaveConfigs(conf, configFile)
-		proxy.StartPoxy(conf, true)
 		configList.Refresh()
+		if err != nil {
+			dialog.ShowError(err, mainWindow)
+		}
 	})
 }
 
 func showEditDialog(cfg *config.ProxyConfig) {
 	showConfigDialog(cfg, func(updated *config.ProxyConfig) {
-		if cfg.Listener != nil {
-			cfg.Listener.Close()
-		}
 		*cfg = *updated
+		err := manager.Restart(cfg)
 		config.SaveConfigs(conf, configFile)
-		proxy.StartPoxy(conf, true)
 		configList.Refresh()
+		if err != nil {
+			dialog.ShowError(err, mainWindow)
+		}
 	})
 }
 
 // 修改后的配置对话框
 func showConfigDialog(cfg *config.ProxyConfig, onSave func(*config.ProxyConfig)) {
-	protocol := widget.NewSelect([]string{"tcp", "udp"}, nil)
+	protocol := widget.NewSelect(config.Protocols, nil)
+	bindAddr := widget.NewSelectEntry([]string{"0.0.0.0", "127.0.0.1", "::", config.DualStack})
 	listenAddr := widget.NewEntry()
 	targetAddr := widget.NewEntry()
+	targets := widget.NewMultiLineEntry()
+	balance := widget.NewSelect(config.Balances, nil)
+	routes := widget.NewMultiLineEntry()
+	allowDest := widget.NewMultiLineEntry()
+	proxyUser := widget.NewEntry()
+	proxyPass := widget.NewPasswordEntry()
+	allowIPs := widget.NewMultiLineEntry()
+	denyIPs := widget.NewMultiLineEntry()
+	maxSessions := widget.NewEntry()
+	maxConns := widget.NewEntry()
+	maxConnsPerIP := widget.NewEntry()
+	acceptRate := widget.NewEntry()
+	acceptBurst := widget.NewEntry()
+	queueConns := widget.NewCheck("", nil)
+	uploadRate := widget.NewEntry()
+	downloadRate := widget.NewEntry()
+	connRate := widget.NewEntry()
+	captureMB := widget.NewEntry()
+	captureSeconds := widget.NewEntry()
+	debugBytes := widget.NewEntry()
+	debugText := widget.NewCheck("", nil)
+	sendProxy := widget.NewSelect(config.ProxyProtocols, nil)
+	acceptProxy := widget.NewCheck("", nil)
+	tlsCert := widget.NewEntry()
+	tlsKey := widget.NewEntry()
+	fingerprint := widget.NewLabel("")
+	fingerprint.Wrapping = fyne.TextWrapBreak
+	targetTLS := widget.NewCheck("", nil)
+	targetSNI := widget.NewEntry()
+	targetCA := widget.NewEntry()
+	targetInsecure := widget.NewCheck("", nil)
+	clientCert := widget.NewEntry()
+	clientKey := widget.NewEntry()
+	healthCheck := widget.NewSelect(config.HealthChecks, nil)
+	healthInterval := widget.NewEntry()
+	healthSend := widget.NewEntry()
+	healthExpect := widget.NewEntry()
+	tcpTimeout := widget.NewEntry()
+	udpTimeout := widget.NewEntry()
+	dialTimeout := widget.NewEntry()
+	writeTimeout := widget.NewEntry()
 
 	// 初始化表单值（仅保留核心参数）
 	protocol.SetSelected(cfg.Protocol)
-	listenAddr.SetText(fmt.Sprintf("%d", cfg.ListenPort))
+	bindAddr.SetText(cfg.ListenHost())
+	listenAddr.SetText(cfg.PortRange())
 	targetAddr.SetText(cfg.TargetAddr)
+	targets.SetText(strings.Join(cfg.Targets, "\n"))
+	routes.SetText(config.FormatRoutes(cfg.Routes))
+	allowDest.SetText(strings.Join(cfg.AllowDest, "\n"))
+	proxyUser.SetText(cfg.ProxyUser)
+	proxyPass.SetText(cfg.ProxyPass)
+	allowIPs.SetText(strings.Join(cfg.AllowIPs, "\n"))
+	denyIPs.SetText(strings.Join(cfg.DenyIPs, "\n"))
+	if cfg.Balance == "" {
+		balance.SetSelected(config.BalanceRoundRobin)
+	} else {
+		balance.SetSelected(cfg.Balance)
+	}
+	maxSessions.SetText(fmt.Sprintf("%d", cfg.MaxSessions))
+	maxConns.SetText(fmt.Sprintf("%d", cfg.MaxConns))
+	maxConnsPerIP.SetText(fmt.Sprintf("%d", cfg.MaxConnsPerIP))
+	acceptRate.SetText(fmt.Sprintf("%d", cfg.AcceptRate))
+	acceptBurst.SetText(fmt.Sprintf("%d", cfg.AcceptBurst))
+	queueConns.SetChecked(cfg.QueueConns)
+	uploadRate.SetText(fmt.Sprintf("%d", cfg.UploadRate))
+	downloadRate.SetText(fmt.Sprintf("%d", cfg.DownloadRate))
+	connRate.SetText(fmt.Sprintf("%d", cfg.ConnRate))
+	captureMB.SetText(fmt.Sprintf("%d", cfg.CaptureMB))
+	captureSeconds.SetText(fmt.Sprintf("%d", cfg.CaptureSeconds))
+	debugBytes.SetText(fmt.Sprintf("%d", cfg.DebugBytes))
+	debugText.SetChecked(cfg.DebugText)
+	sendProxy.SetSelected(cfg.SendProxy)
+	acceptProxy.SetChecked(cfg.AcceptProxy)
+	tlsCert.SetText(cfg.TLSCert)
+	tlsKey.SetText(cfg.TLSKey)
+	targetTLS.SetChecked(cfg.TargetTLS)
+	targetSNI.SetText(cfg.TargetServerName)
+	targetCA.SetText(cfg.TargetCA)
+	targetInsecure.SetChecked(cfg.TargetInsecure)
+	clientCert.SetText(cfg.TargetClientCert)
+	clientKey.SetText(cfg.TargetClientKey)
+	// 只有tls协议显示证书指纹,没有配置证书时会生成自签名证书
+	if cfg.Protocol == "tls" {
+		if fp, err := proxy.CertFingerprint(cfg); err != nil {
+			fingerprint.SetText(err.Error())
+		} else {
+			fingerprint.SetText(fp)
+		}
+	}
+	healthCheck.SetSelected(cfg.HealthCheck)
+	healthInterval.SetText(fmt.Sprintf("%d", cfg.HealthInterval))
+	healthSend.SetText(cfg.HealthSend)
+	healthExpect.SetText(cfg.HealthExpect)
+	tcpTimeout.SetText(fmt.Sprintf("%d", cfg.TCPTimeout))
+	udpTimeout.SetText(fmt.Sprintf("%d", cfg.UDPTimeout))
+	dialTimeout.SetText(fmt.Sprintf("%d", cfg.DialTimeout))
+	writeTimeout.SetText(fmt.Sprintf("%d", cfg.WriteTimeout))
 
 	form := &widget.Form{
 		Items: []*widget.FormItem{
 			{Text: config.GetLang("Protocol"), Widget: protocol},
+			{Text: config.GetLang("BindAddr"), Widget: bindAddr},
 			{Text: config.GetLang("ListenAddr"), Widget: listenAddr},
 			{Text: config.GetLang("TargetAddr"), Widget: targetAddr},
+			{Text: config.GetLang("Targets"), Widget: targets},
+			{Text: config.GetLang("Balance"), Widget: balance},
+			{Text: config.GetLang("Routes"), Widget: routes},
+			{Text: config.GetLang("AllowDest"), Widget: allowDest},
+			{Text: config.GetLang("ProxyUser"), Widget: proxyUser},
+			{Text: config.GetLang("ProxyPass"), Widget: proxyPass},
+			{Text: config.GetLang("AllowIPs"), Widget: allowIPs},
+			{Text: config.GetLang("DenyIPs"), Widget: denyIPs},
+			{Text: config.GetLang("MaxSessions"), Widget: maxSessions},
+			{Text: config.GetLang("MaxConns"), Widget: maxConns},
+			{Text: config.GetLang("MaxConnsPerIP"), Widget: maxConnsPerIP},
+			{Text: config.GetLang("AcceptRate"), Widget: acceptRate},
+			{Text: config.GetLang("AcceptBurst"), Widget: acceptBurst},
+			{Text: config.GetLang("QueueConns"), Widget: queueConns},
+			{Text: config.GetLang("UploadRate"), Widget: uploadRate},
+			{Text: config.GetLang("DownloadRate"), Widget: downloadRate},
+			{Text: config.GetLang("ConnRate"), Widget: connRate},
+			{Text: config.GetLang("CaptureMB"), Widget: captureMB},
+			{Text: config.GetLang("CaptureSeconds"), Widget: captureSeconds},
+			{Text: config.GetLang("DebugBytes"), Widget: debugBytes},
+			{Text: config.GetLang("DebugText"), Widget: debugText},
+			{Text: config.GetLang("SendProxy"), Widget: sendProxy},
+			{Text: config.GetLang("AcceptProxy"), Widget: acceptProxy},
+			{Text: config.GetLang("TLSCert"), Widget: tlsCert},
+			{Text: config.GetLang("TLSKey"), Widget: tlsKey},
+			{Text: config.GetLang("Fingerprint"), Widget: fingerprint},
+			{Text: config.GetLang("TargetTLS"), Widget: targetTLS},
+			{Text: config.GetLang("TargetSNI"), Widget: targetSNI},
+			{Text: config.GetLang("TargetCA"), Widget: targetCA},
+			{Text: config.GetLang("TargetInsecure"), Widget: targetInsecure},
+			{Text: config.GetLang("ClientCert"), Widget: clientCert},
+			{Text: config.GetLang("ClientKey"), Widget: clientKey},
+			{Text: config.GetLang("HealthCheck"), Widget: healthCheck},
+			{Text: config.GetLang("HealthInterval"), Widget: healthInterval},
+			{Text: config.GetLang("HealthSend"), Widget: healthSend},
+			{Text: config.GetLang("HealthExpect"), Widget: healthExpect},
+			{Text: config.GetLang("TCPTimeout"), Widget: tcpTimeout},
+			{Text: config.GetLang("UDPTimeout"), Widget: udpTimeout},
+			{Text: config.GetLang("DialTimeout"), Widget: dialTimeout},
+			{Text: config.GetLang("WriteTimeout"), Widget: writeTimeout},
 		},
 	}
 
+	// 选项较多,放进滚动区域
+	formScroll := container.NewVScroll(form)
+	formScroll.SetMinSize(fyne.NewSize(500, 500))
+
 	var confDialog *dialog.ConfirmDialog
-	confDialog = dialog.NewCustomConfirm(config.GetLang("EditSettings"), config.GetLang("Save"), config.GetLang("Cancel"), form, func(b bool) {
+	confDialog = dialog.NewCustomConfirm(config.GetLang("EditSettings"), config.GetLang("Save"), config.GetLang("Cancel"), formScroll, func(b bool) {
 		if !b {
 			return
 		}
-		num, _ := strconv.ParseInt(listenAddr.Text, 10, 64)
+		// 在原配置上修改,保留对话框里没有的字段
+		newCfg := *cfg
+		newCfg.Protocol = protocol.Selected
+		newCfg.ListenAddr = bindAddr.Text
+		newCfg.TargetAddr = targetAddr.Text
+		newCfg.Targets = nil
+		for _, v := range strings.Split(targets.Text, "\n") {
+			if v = strings.TrimSpace(v); v != "" {
+				newCfg.Targets = append(newCfg.Targets, v)
+			}
+		}
+		newCfg.Balance = balance.Selected
+		var errRoutes error
+		if newCfg.Routes, errRoutes = config.ParseRoutes(routes.Text); errRoutes != nil {
+			ErrorDialog := dialog.NewError(errors.New(config.GetLang("RouteErrMsg")), mainWindow)
+			ErrorDialog.Show()
+			ErrorDialog.SetOnClosed(func() {
+				confDialog.Show()
+			})
+			return
+		}
+		port, portEnd, err := config.ParsePortRange(listenAddr.Text)
+		newCfg.ListenPort, newCfg.ListenPortEnd = port, portEnd
 
-		if num < 1 || num > 65535 {
+		if err != nil || !newCfg.ValidPorts() {
 			ErrorDialog := dialog.NewError(errors.New(config.GetLang("PortErrMsg")), mainWindow)
 			ErrorDialog.Show()
 			ErrorDialog.SetOnClosed(func() {
@@ -211,15 +457,105 @@ func showConfigDialog(cfg *config.ProxyConfig, onSave func(*config.ProxyConfig))
 			})
 			return
 		}
-		newCfg := &config.ProxyConfig{
-			ID:         cfg.ID,
-			Protocol:   protocol.Selected,
-			ListenPort: int(num),
-			TargetAddr: targetAddr.Text,
+		newCfg.AllowDest = nil
+		for _, v := range strings.Split(allowDest.Text, "\n") {
+			if v = strings.TrimSpace(v); v != "" {
+				newCfg.AllowDest = append(newCfg.AllowDest, v)
+			}
+		}
+		newCfg.ProxyUser = strings.TrimSpace(proxyUser.Text)
+		newCfg.ProxyPass = proxyPass.Text
+		newCfg.AllowIPs = splitLines(allowIPs.Text)
+		newCfg.DenyIPs = splitLines(denyIPs.Text)
+		if !config.ValidIPList(newCfg.AllowIPs) || !config.ValidIPList(newCfg.DenyIPs) {
+			ErrorDialog := dialog.NewError(errors.New(config.GetLang("IPListErrMsg")), mainWindow)
+			ErrorDialog.Show()
+			ErrorDialog.SetOnClosed(func() {
+				confDialog.Show()
+			})
+			return
+		}
+		var errLimits [11]error
+		newCfg.MaxSessions, errLimits[0] = parseNumber(maxSessions.Text)
+		newCfg.MaxConns, errLimits[1] = parseNumber(maxConns.Text)
+		newCfg.MaxConnsPerIP, errLimits[2] = parseNumber(maxConnsPerIP.Text)
+		newCfg.AcceptRate, errLimits[3] = parseNumber(acceptRate.Text)
+		newCfg.AcceptBurst, errLimits[4] = parseNumber(acceptBurst.Text)
+		newCfg.UploadRate, errLimits[5] = parseNumber(uploadRate.Text)
+		newCfg.DownloadRate, errLimits[6] = parseNumber(downloadRate.Text)
+		newCfg.ConnRate, errLimits[7] = parseNumber(connRate.Text)
+		newCfg.CaptureMB, errLimits[8] = parseNumber(captureMB.Text)
+		newCfg.CaptureSeconds, errLimits[9] = parseNumber(captureSeconds.Text)
+		newCfg.DebugBytes, errLimits[10] = parseNumber(debugBytes.Text)
+		newCfg.DebugText = debugText.Checked
+		newCfg.QueueConns = queueConns.Checked
+		if errors.Join(errLimits[:]...) != nil || !newCfg.ValidLimits() {
+			ErrorDialog := dialog.NewError(errors.New(config.GetLang("LimitErrMsg")), mainWindow)
+			ErrorDialog.Show()
+			ErrorDialog.SetOnClosed(func() {
+				confDialog.Show()
+			})
+			return
+		}
+		newCfg.SendProxy = sendProxy.Selected
+		newCfg.AcceptProxy = acceptProxy.Checked
+		newCfg.TLSCert = strings.TrimSpace(tlsCert.Text)
+		newCfg.TLSKey = strings.TrimSpace(tlsKey.Text)
+		newCfg.TargetTLS = targetTLS.Checked
+		newCfg.TargetServerName = strings.TrimSpace(targetSNI.Text)
+		newCfg.TargetCA = strings.TrimSpace(targetCA.Text)
+		newCfg.TargetInsecure = targetInsecure.Checked
+		newCfg.TargetClientCert = strings.TrimSpace(clientCert.Text)
+		newCfg.TargetClientKey = strings.TrimSpace(clientKey.Text)
+
+		var err1, err2, err3, err4 error
+		newCfg.TCPTimeout, err1 = parseNumber(tcpTimeout.Text)
+		newCfg.UDPTimeout, err2 = parseNumber(udpTimeout.Text)
+		newCfg.DialTimeout, err3 = parseNumber(dialTimeout.Text)
+		newCfg.WriteTimeout, err4 = parseNumber(writeTimeout.Text)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			ErrorDialog := dialog.NewError(errors.New(config.GetLang("TimeoutErrMsg")), mainWindow)
+			ErrorDialog.Show()
+			ErrorDialog.SetOnClosed(func() {
+				confDialog.Show()
+			})
+			return
+		}
+
+		var errInterval error
+		newCfg.HealthCheck = healthCheck.Selected
+		newCfg.HealthInterval, errInterval = parseNumber(healthInterval.Text)
+		newCfg.HealthSend = healthSend.Text
+		newCfg.HealthExpect = strings.TrimSpace(healthExpect.Text)
+		if errInterval != nil || !newCfg.ValidHealthCheck() {
+			ErrorDialog := dialog.NewError(errors.New(config.GetLang("HealthErrMsg")), mainWindow)
+			ErrorDialog.Show()
+			ErrorDialog.SetOnClosed(func() {
+				confDialog.Show()
+			})
+			return
+		}
+
+		if !newCfg.ValidListenAddr() {
+			ErrorDialog := dialog.NewError(errors.New(config.GetLang("BindAddrErrMsg")), mainWindow)
+			ErrorDialog.Show()
+			ErrorDialog.SetOnClosed(func() {
+				confDialog.Show()
+			})
+			return
+		}
+
+		if newCfg.OpenRelay() {
+			ErrorDialog := dialog.NewError(errors.New(config.GetLang("RelayErrMsg")), mainWindow)
+			ErrorDialog.Show()
+			ErrorDialog.SetOnClosed(func() {
+				confDialog.Show()
+			})
+			return
 		}
 
 		for _, v := range conf.Configs {
-			if v.Protocol == newCfg.Protocol && v.ListenPort == newCfg.ListenPort {
+			if v.Conflicts(&newCfg) {
 				if v.ID != newCfg.ID {
 					ErrorDialog := dialog.NewError(errors.New(config.GetLang("PortErrUsed")), mainWindow)
 					ErrorDialog.Show()
@@ -231,7 +567,7 @@ func showConfigDialog(cfg *config.ProxyConfig, onSave func(*config.ProxyConfig))
 			}
 		}
 
-		onSave(newCfg)
+		onSave(&newCfg)
 	}, mainWindow)
 	confDialog.Show()
 }
@@ -251,6 +587,19 @@ func showGlobalSettings() {
 	showWslCheck.SetChecked(conf.ShowWsl)
 	hideWindowCheck.SetChecked(conf.HideWindow)
 	AutoUseWslIpCheck.SetChecked(conf.AutoUseWslIp)
+
+	tcpTimeout := widget.NewEntry()
+	udpTimeout := widget.NewEntry()
+	dialTimeout := widget.NewEntry()
+	writeTimeout := widget.NewEntry()
+	tcpTimeout.SetText(fmt.Sprintf("%d", conf.TCPTimeout))
+	udpTimeout.SetText(fmt.Sprintf("%d", conf.UDPTimeout))
+	dialTimeout.SetText(fmt.Sprintf("%d", conf.DialTimeout))
+	writeTimeout.SetText(fmt.Sprintf("%d", conf.WriteTimeout))
+	allowIPs := widget.NewMultiLineEntry()
+	denyIPs := widget.NewMultiLineEntry()
+	allowIPs.SetText(strings.Join(conf.AllowIPs, "\n"))
+	denyIPs.SetText(strings.Join(conf.DenyIPs, "\n"))
 	form := &widget.Form{
 		Items: []*widget.FormItem{
 			{Text: config.GetLang("WslStart"), Widget: startWslCheck},
@@ -258,17 +607,59 @@ func showGlobalSettings() {
 			{Text: config.GetLang("WslShow"), Widget: showWslCheck},
 			{Text: config.GetLang("HideWindow"), Widget: hideWindowCheck},
 			{Text: config.GetLang("AutoUseWslIp"), Widget: AutoUseWslIpCheck},
+			{Text: config.GetLang("TCPTimeout"), Widget: tcpTimeout},
+			{Text: config.GetLang("UDPTimeout"), Widget: udpTimeout},
+			{Text: config.GetLang("DialTimeout"), Widget: dialTimeout},
+			{Text: config.GetLang("WriteTimeout"), Widget: writeTimeout},
+			{Text: config.GetLang("AllowIPs"), Widget: allowIPs},
+			{Text: config.GetLang("DenyIPs"), Widget: denyIPs},
 		},
 	}
 
 	dialog.ShowCustomConfirm(config.GetLang("GlobalSettings"), config.GetLang("Save"), config.GetLang("Cancel"), form, func(b bool) {
 		if b {
+			tcpSec, err1 := parseNumber(tcpTimeout.Text)
+			udpSec, err2 := parseNumber(udpTimeout.Text)
+			dialSec, err3 := parseNumber(dialTimeout.Text)
+			writeSec, err4 := parseNumber(writeTimeout.Text)
+			if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+				dialog.ShowError(errors.New(config.GetLang("TimeoutErrMsg")), mainWindow)
+				return
+			}
+			allow, deny := splitLines(allowIPs.Text), splitLines(denyIPs.Text)
+			if !config.ValidIPList(allow) || !config.ValidIPList(deny) {
+				dialog.ShowError(errors.New(config.GetLang("IPListErrMsg")), mainWindow)
+				return
+			}
+			conf.AllowIPs, conf.DenyIPs = allow, deny
 			conf.WslArgs = wslCommandEntry.Text
+			conf.TCPTimeout, conf.UDPTimeout, conf.DialTimeout, conf.WriteTimeout = tcpSec, udpSec, dialSec, writeSec
+			manager.SetGlobal(conf)
 			config.SaveConfigs(conf, configFile)
 		}
 	}, mainWindow)
 }
 
+// splitLines 按行拆分,去掉空白行
+func splitLines(text string) []string {
+	var list []string
+	for _, v := range strings.Split(text, "\n") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// parseNumber 解析超时秒数和数量限制,空白为0
+func parseNumber(text string) (int, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(text)
+}
+
 func initLog() {
 	r, w, _ := os.Pipe()
 	log.SetOutput(w)
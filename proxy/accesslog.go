@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	accessLogMaxSize  = 10 << 20    // 访问日志超过10MB时轮转
+	accessLogBackups  = 3           // 保留 access.log.1 ~ access.log.3
+	accessLogMaxRetry = time.Minute // 打开失败后重试的最长间隔
+)
+
+// 连接关闭的原因
+const (
+	closeEOF     = "eof"
+	closeIdle    = "idle timeout"
+	closeStalled = "write timeout"
+	closeReset   = "reset"
+	closeDial    = "dial failure"
+	closeError   = "error"
+	closeEvicted = "session limit"
+	closeStopped = "rule stopped"
+)
+
+// accessRecord 访问日志中的一行,每条TCP连接或UDP会话结束时写入
+type accessRecord struct {
+	Rule     string    `json:"rule"`
+	Protocol string    `json:"protocol"`
+	Client   string    `json:"client"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+	Reason   string    `json:"reason"`
+}
+
+// accessLog 按JSON Lines写入的访问日志,按大小轮转,第一次写入时才打开文件
+type accessLog struct {
+	path    string
+	maxSize int64
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	backoff time.Duration // 打开失败后等待的时间,每次失败加倍,避免每条连接都记一次错误日志
+	retry   time.Time     // 这之前的记录直接丢弃
+}
+
+func newAccessLog(path string) *accessLog {
+	return &accessLog{path: path, maxSize: accessLogMaxSize}
+}
+
+func (l *accessLog) write(rec *accessRecord) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil || l.size+int64(len(line)) > l.maxSize {
+		now := time.Now()
+		if now.Before(l.retry) {
+			return
+		}
+		if err := l.open(l.f != nil); err != nil {
+			l.backoff = min(max(2*l.backoff, time.Second), accessLogMaxRetry)
+			l.retry = now.Add(l.backoff)
+			log.Printf("access log %s err: %v; retrying in %v\r\n", l.path, err, l.backoff)
+			return
+		}
+		l.backoff = 0
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("access log %s write err: %v\r\n", l.path, err)
+	}
+}
+
+// open 打开日志文件,rotate为true时先把现有文件依次改名为 .1 .2 ...
+func (l *accessLog) open(rotate bool) error {
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	if rotate {
+		for i := accessLogBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	// 启动时已有的文件太大,马上轮转
+	if !rotate && l.size >= l.maxSize {
+		return l.open(true)
+	}
+	return nil
+}
+
+// setReason 记录连接关闭的原因,只保留第一次设置的
+func (t *tracked) setReason(reason string) {
+	t.reason.CompareAndSwap(nil, &reason)
+}
+
+func (t *tracked) record() *accessRecord {
+	reason := closeEOF
+	if p := t.reason.Load(); p != nil {
+		reason = *p
+	}
+	return &accessRecord{
+		Rule:     t.rule,
+		Protocol: t.protocol,
+		Client:   t.client,
+		Target:   t.targetAddr(),
+		Start:    t.start,
+		End:      time.Now(),
+		BytesIn:  t.bytesIn.Load(),
+		BytesOut: t.bytesOut.Load(),
+		Reason:   reason,
+	}
+}
+
+// relayReason 根据转发结束时的错误判断关闭原因,idle为nil时不检查空闲超时
+func relayReason(idle *idleWatch, err error) string {
+	switch {
+	case idle != nil && idle.expired.Load():
+		return closeIdle
+	case err == nil:
+		return closeEOF
+	case errors.Is(err, errWriteStall):
+		return closeStalled
+	case isReset(err):
+		return closeReset
+	}
+	return closeError
+}
+
+// wsaeconnreset Windows上的连接重置错误码
+const wsaeconnreset = syscall.Errno(10054)
+
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, wsaeconnreset)
+}
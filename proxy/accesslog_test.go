@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// readAccessLog 读出日志文件中的全部记录
+func readAccessLog(t *testing.T, path string) []accessRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []accessRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec accessRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("%s: bad line %q: %v", path, sc.Text(), err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l := newAccessLog(path)
+	l.maxSize = 400
+	for i := 0; i < 30; i++ {
+		l.write(&accessRecord{Rule: fmt.Sprint(i), Protocol: "tcp", Reason: closeEOF})
+	}
+	l.f.Close()
+
+	last := -1
+	for i := accessLogBackups; i >= 0; i-- {
+		name := path
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", path, i)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > l.maxSize {
+			t.Errorf("%s is %d bytes, limit %d", name, info.Size(), l.maxSize)
+		}
+		// 旧文件里的记录在前,编号连续
+		for _, rec := range readAccessLog(t, name) {
+			var n int
+			fmt.Sscan(rec.Rule, &n)
+			if last >= 0 && n != last+1 {
+				t.Fatalf("%s: record %d follows %d", name, n, last)
+			}
+			last = n
+		}
+	}
+	if last != 29 {
+		t.Fatalf("newest record %d, want 29", last)
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.%d", path, accessLogBackups+1)); !os.IsNotExist(err) {
+		t.Fatalf("kept more than %d backups", accessLogBackups)
+	}
+}
+
+func TestAccessLogRetry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	// 目录的位置是一个文件,打开日志会失败
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := newAccessLog(filepath.Join(dir, "access.log"))
+	l.write(&accessRecord{Rule: "lost"})
+	if l.f != nil || l.backoff == 0 {
+		t.Fatal("open failure not backed off")
+	}
+	os.Remove(dir)
+	l.write(&accessRecord{Rule: "dropped"})
+	if l.f != nil {
+		t.Fatal("retried before the backoff expired")
+	}
+	l.retry = time.Time{}
+	l.write(&accessRecord{Rule: "kept"})
+	if l.f == nil {
+		t.Fatal("not retried after the backoff expired")
+	}
+	l.f.Close()
+	recs := readAccessLog(t, l.path)
+	if len(recs) != 1 || recs[0].Rule != "kept" || l.backoff != 0 {
+		t.Fatalf("records %+v, backoff %v", recs, l.backoff)
+	}
+}
+
+func TestAccessLogDialFailure(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := closed.Addr().String()
+	closed.Close()
+
+	r := newTestRule(&config.ProxyConfig{ID: "dial", Protocol: "tcp", ListenAddr: "127.0.0.1", TargetAddr: target})
+	r.targets = []string{target}
+	r.access = newAccessLog(filepath.Join(t.TempDir(), "access.log"))
+	if err := r.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.stop()
+	c, err := net.Dial("tcp", r.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, c) // 连接目标失败后代理关闭连接
+	c.Close()
+
+	r.access.mu.Lock()
+	recs := readAccessLog(t, r.access.path)
+	r.access.mu.Unlock()
+	if len(recs) != 1 || recs[0].Target != target || recs[0].Reason != closeDial {
+		t.Fatalf("records %+v, want target %s with reason %q", recs, target, closeDial)
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseNet 解析CIDR或单个IP,都不是时返回nil
+func parseNet(v string) *net.IPNet {
+	if _, n, err := net.ParseCIDR(v); err == nil {
+		return n
+	}
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil
+	}
+	bits := 8 * len(ip.To16())
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+}
+
+func parseNets(list []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range list {
+		if n := parseNet(strings.TrimSpace(v)); n != nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipACL 客户端IP的允许和拒绝列表,拒绝优先,允许列表为空时允许所有
+type ipACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newIPACL(allow, deny []string) *ipACL {
+	return &ipACL{allow: parseNets(allow), deny: parseNets(deny)}
+}
+
+func (a *ipACL) allowed(ip net.IP) bool {
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
+
+// clientAllowed 检查客户端IP,规则没有设置列表时使用全局列表;
+// 全局列表每次读取,修改全局设置后不用重启规则
+func (r *rule) clientAllowed(addr net.Addr) bool {
+	acl := r.acl
+	if acl == nil {
+		acl = r.globals().acl
+	}
+	ip, _ := addrIPPort(addr)
+	if ip == nil || acl == nil || acl.allowed(ip) {
+		return true
+	}
+	r.stats.denied.Add(1)
+	return false
+}
+
+// deniedLog 同一个UDP客户端被拒绝时每分钟只记录一次日志
+type deniedLog struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+const deniedLogInterval = time.Minute
+
+func (d *deniedLog) shouldLog(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.last == nil || len(d.last) >= defaultMaxUDPSessions {
+		d.last = make(map[string]time.Time)
+	}
+	if t, ok := d.last[key]; ok && now.Sub(t) < deniedLogInterval {
+		return false
+	}
+	d.last[key] = now
+	return true
+}
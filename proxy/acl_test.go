@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+func TestClientAllowed(t *testing.T) {
+	ip := func(s string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(s), Port: 40000} }
+	for _, tc := range []struct {
+		name                    string
+		globalAllow, globalDeny []string
+		allow, deny             []string
+		client                  net.Addr
+		want                    bool
+	}{
+		{name: "no lists", client: ip("192.0.2.1"), want: true},
+		{name: "global allow cidr", globalAllow: []string{"10.0.0.0/8"}, client: ip("10.1.2.3"), want: true},
+		{name: "global allow miss", globalAllow: []string{"10.0.0.0/8"}, client: ip("192.0.2.1")},
+		{name: "global deny single ip", globalDeny: []string{"192.0.2.1"}, client: ip("192.0.2.1")},
+		{name: "global deny other ip", globalDeny: []string{"192.0.2.1"}, client: ip("192.0.2.2"), want: true},
+		{name: "deny beats allow", allow: []string{"192.0.2.0/24"}, deny: []string{"192.0.2.7"}, client: ip("192.0.2.7")},
+		{name: "allow around deny", allow: []string{"192.0.2.0/24"}, deny: []string{"192.0.2.7"}, client: ip("192.0.2.8"), want: true},
+		// 规则有自己的列表时完全不看全局列表
+		{name: "rule allow overrides global deny", globalDeny: []string{"192.0.2.0/24"}, allow: []string{"192.0.2.1"},
+			client: ip("192.0.2.1"), want: true},
+		{name: "rule deny ignores global allow", globalAllow: []string{"192.0.2.0/24"}, deny: []string{"10.0.0.1"},
+			client: ip("198.51.100.1"), want: true},
+		{name: "rule allow ignores global allow", globalAllow: []string{"198.51.100.0/24"}, allow: []string{"192.0.2.0/24"},
+			client: ip("198.51.100.1")},
+		{name: "mapped ipv4", allow: []string{"10.0.0.0/8"}, client: ip("::ffff:10.0.0.1"), want: true},
+		{name: "ipv6 cidr", allow: []string{"2001:db8::/32"}, client: ip("2001:db8::1"), want: true},
+		{name: "ipv6 single miss", allow: []string{"2001:db8::1"}, client: ip("2001:db8::2")},
+		{name: "udp client", deny: []string{"192.0.2.1"}, client: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}},
+		{name: "invalid entries ignored", allow: []string{"bogus", " 192.0.2.1 "}, client: ip("192.0.2.1"), want: true},
+		{name: "no ip", deny: []string{"0.0.0.0/0"}, client: &net.UnixAddr{Name: "sock", Net: "unix"}, want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.ProxyConfig{ID: "acl", Protocol: "tcp", AllowIPs: tc.allow, DenyIPs: tc.deny}
+			r := newTestRule(cfg)
+			r.global.Store(newGlobalSettings(&config.Conf{AllowIPs: tc.globalAllow, DenyIPs: tc.globalDeny}))
+			if len(cfg.AllowIPs) > 0 || len(cfg.DenyIPs) > 0 {
+				r.acl = newIPACL(cfg.AllowIPs, cfg.DenyIPs)
+			}
+			if got := r.clientAllowed(tc.client); got != tc.want {
+				t.Fatalf("clientAllowed(%v) = %v, want %v", tc.client, got, tc.want)
+			}
+			want := int64(1)
+			if tc.want {
+				want = 0
+			}
+			if got := r.stats.denied.Load(); got != want {
+				t.Fatalf("denied = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestClientAllowedGlobalChange 修改全局列表后运行中的规则马上使用新列表
+func TestClientAllowedGlobalChange(t *testing.T) {
+	r := newTestRule(&config.ProxyConfig{ID: "acl", Protocol: "tcp"})
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	if !r.clientAllowed(client) {
+		t.Fatal("denied with no lists")
+	}
+	r.global.Store(newGlobalSettings(&config.Conf{DenyIPs: []string{"192.0.2.0/24"}}))
+	if r.clientAllowed(client) {
+		t.Fatal("allowed after the global deny list changed")
+	}
+	r.global.Store(newGlobalSettings(&config.Conf{}))
+	if !r.clientAllowed(client) {
+		t.Fatal("denied after the global lists were cleared")
+	}
+	if got := r.stats.denied.Load(); got != 1 {
+		t.Fatalf("denied = %d, want 1", got)
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// backend 一个目标地址
+type backend struct {
+	addr    string
+	active  atomic.Int64 // 当前连接数,least-conn使用
+	down    atomic.Bool  // 健康检查失败
+	checked atomic.Bool  // 已经有健康检查结果
+}
+
+// done 连接结束时调用
+func (b *backend) done() {
+	b.active.Add(-1)
+}
+
+// balancer 一个监听端口的全部目标,按策略选择目标,连接失败时依次尝试后面的目标
+type balancer struct {
+	id       int // 在rule.balancers中的序号
+	strategy string
+	backends []*backend
+	next     atomic.Uint64
+}
+
+func newBalancer(strategy string, addrs []string) *balancer {
+	lb := &balancer{strategy: strategy}
+	for _, addr := range addrs {
+		lb.backends = append(lb.backends, &backend{addr: addr})
+	}
+	return lb
+}
+
+func (lb *balancer) String() string {
+	if len(lb.backends) == 0 {
+		return "*" // 目标由客户端指定
+	}
+	addrs := make([]string, len(lb.backends))
+	for i, b := range lb.backends {
+		addrs[i] = b.addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+// pick 返回本次连接尝试目标的顺序:第一个按策略选出,其余用于故障转移。
+// 健康检查失败的目标会被跳过,全部失败时仍然全部尝试
+func (lb *balancer) pick(client net.Addr) []*backend {
+	if len(lb.backends) == 1 {
+		return lb.backends
+	}
+	backends := lb.healthy()
+	n := len(backends)
+	first := 0
+	switch lb.strategy {
+	case config.BalanceLeastConn:
+		for i, b := range backends {
+			if b.active.Load() < backends[first].active.Load() {
+				first = i
+			}
+		}
+	case config.BalanceRandom:
+		first = rand.IntN(n)
+	case config.BalanceSourceHash:
+		h := fnv.New32a()
+		h.Write([]byte(clientIP(client)))
+		first = int(h.Sum32() % uint32(n))
+	default:
+		first = int((lb.next.Add(1) - 1) % uint64(n))
+	}
+	order := make([]*backend, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, backends[(first+i)%n])
+	}
+	return order
+}
+
+// healthy 返回健康的目标,没有健康的目标时返回全部
+func (lb *balancer) healthy() []*backend {
+	up := 0
+	for _, b := range lb.backends {
+		if !b.down.Load() {
+			up++
+		}
+	}
+	if up == len(lb.backends) || up == 0 {
+		return lb.backends
+	}
+	list := make([]*backend, 0, up)
+	for _, b := range lb.backends {
+		if !b.down.Load() {
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// dial 按pick的顺序连接目标,成功后目标的连接数加一,结束时要调用backend.done。
+// hdr是连接后首先发送的PROXY头,开启TargetTLS时在TLS握手之前发送
+func (r *rule) dial(network string, lb *balancer, client net.Addr, hdr []byte) (net.Conn, *backend, error) {
+	var lastErr error
+	for _, b := range lb.pick(client) {
+		c, err := r.dialBackend(network, b.addr, hdr, r.dialTimeout())
+		if err == nil {
+			b.active.Add(1)
+			return c, b, nil
+		}
+		r.stats.dialFailures.Add(1)
+		log.Printf("%s connect %s err: %v\r\n", strings.ToUpper(network), b.addr, err)
+		lastErr = err
+	}
+	return nil, nil, lastErr
+}
+
+// dialBackend 连接一个目标,先发送PROXY头,再按设置完成TLS握手;健康检查也用它连接
+func (r *rule) dialBackend(network, addr string, hdr []byte, timeout time.Duration) (net.Conn, error) {
+	c, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if hdr != nil {
+		if _, err := c.Write(hdr); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if network == "tcp" && r.targetTLS != nil {
+		return r.tlsClient(c, addr, timeout)
+	}
+	return c, nil
+}
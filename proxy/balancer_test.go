@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// order 把pick的结果转成目标地址
+func order(list []*backend) []string {
+	addrs := make([]string, len(list))
+	for i, b := range list {
+		addrs[i] = b.addr
+	}
+	return addrs
+}
+
+func TestBalancerPick(t *testing.T) {
+	addrs := []string{"a:1", "b:1", "c:1"}
+	client := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+	for _, tc := range []struct {
+		name     string
+		strategy string
+		setup    func(lb *balancer)
+		client   net.Addr
+		want     [][]string // 连续几次pick的顺序
+	}{
+		{name: "round robin", strategy: config.BalanceRoundRobin, client: client("192.0.2.1"),
+			want: [][]string{{"a:1", "b:1", "c:1"}, {"b:1", "c:1", "a:1"}, {"c:1", "a:1", "b:1"}, {"a:1", "b:1", "c:1"}}},
+		{name: "default is round robin", client: client("192.0.2.1"),
+			want: [][]string{{"a:1", "b:1", "c:1"}, {"b:1", "c:1", "a:1"}}},
+		{name: "least conn", strategy: config.BalanceLeastConn, client: client("192.0.2.1"),
+			setup: func(lb *balancer) {
+				lb.backends[0].active.Store(3)
+				lb.backends[1].active.Store(1)
+				lb.backends[2].active.Store(2)
+			},
+			want: [][]string{{"b:1", "c:1", "a:1"}, {"b:1", "c:1", "a:1"}}},
+		{name: "least conn tie picks first", strategy: config.BalanceLeastConn, client: client("192.0.2.1"),
+			want: [][]string{{"a:1", "b:1", "c:1"}}},
+		{name: "skip unhealthy", strategy: config.BalanceRoundRobin, client: client("192.0.2.1"),
+			setup: func(lb *balancer) { lb.backends[1].down.Store(true) },
+			want:  [][]string{{"a:1", "c:1"}, {"c:1", "a:1"}, {"a:1", "c:1"}}},
+		{name: "all unhealthy tries all", strategy: config.BalanceRoundRobin, client: client("192.0.2.1"),
+			setup: func(lb *balancer) {
+				for _, b := range lb.backends {
+					b.down.Store(true)
+				}
+			},
+			want: [][]string{{"a:1", "b:1", "c:1"}}},
+		{name: "least conn skips unhealthy", strategy: config.BalanceLeastConn, client: client("192.0.2.1"),
+			setup: func(lb *balancer) {
+				lb.backends[0].active.Store(5)
+				lb.backends[1].down.Store(true)
+				lb.backends[2].active.Store(1)
+			},
+			want: [][]string{{"c:1", "a:1"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lb := newBalancer(tc.strategy, addrs)
+			if tc.setup != nil {
+				tc.setup(lb)
+			}
+			for i, want := range tc.want {
+				if got := order(lb.pick(tc.client)); !slices.Equal(got, want) {
+					t.Fatalf("pick %d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestBalancerSourceHash 同一客户端IP总是先选同一目标,端口不影响选择
+func TestBalancerSourceHash(t *testing.T) {
+	lb := newBalancer(config.BalanceSourceHash, []string{"a:1", "b:1", "c:1", "d:1"})
+	seen := map[string]bool{}
+	for i := 0; i < 64; i++ {
+		ip := net.IPv4(10, 0, byte(i/256), byte(i))
+		first := lb.pick(&net.TCPAddr{IP: ip, Port: 1000})[0].addr
+		for port := 1001; port < 1005; port++ {
+			if got := lb.pick(&net.TCPAddr{IP: ip, Port: port})[0].addr; got != first {
+				t.Fatalf("client %v port %d picked %s, earlier %s", ip, port, got, first)
+			}
+		}
+		if got := lb.pick(&net.UDPAddr{IP: ip, Port: 53})[0].addr; got != first {
+			t.Fatalf("udp client %v picked %s, tcp picked %s", ip, got, first)
+		}
+		seen[first] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("64 clients all hashed to %v", seen)
+	}
+	// 目标不健康时换到其他目标,恢复后回到原来的目标
+	client := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 1000}
+	first := lb.pick(client)[0]
+	first.down.Store(true)
+	if got := lb.pick(client)[0]; got == first {
+		t.Fatalf("picked unhealthy %s", got.addr)
+	}
+	first.down.Store(false)
+	if got := lb.pick(client)[0]; got != first {
+		t.Fatalf("picked %s after recovery, want %s", got.addr, first.addr)
+	}
+}
+
+// TestBalancerRandom 每次都尝试全部目标,各目标都会被先选到
+func TestBalancerRandom(t *testing.T) {
+	lb := newBalancer(config.BalanceRandom, []string{"a:1", "b:1", "c:1"})
+	seen := map[string]bool{}
+	for i := 0; i < 200; i++ {
+		got := lb.pick(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1})
+		if len(got) != 3 {
+			t.Fatalf("pick = %v", order(got))
+		}
+		seen[got[0].addr] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("first picks %v, want all targets", seen)
+	}
+}
+
+// TestDialFailover 第一个目标连不上时连接下一个,失败次数计入统计
+func TestDialFailover(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := closed.Addr().String()
+	closed.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	r := newTestRule(&config.ProxyConfig{ID: "lb", Protocol: "tcp"})
+	lb := newBalancer(config.BalanceRoundRobin, []string{dead, ln.Addr().String()})
+	client := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	c, b, err := r.dial("tcp", lb, client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if b.addr != ln.Addr().String() || b.active.Load() != 1 {
+		t.Fatalf("dialed %s with %d active, want %s with 1", b.addr, b.active.Load(), ln.Addr())
+	}
+	b.done()
+	if got := r.stats.dialFailures.Load(); got != 1 {
+		t.Fatalf("dial failures = %d, want 1", got)
+	}
+
+	// 全部失败时返回最后一个错误
+	lb = newBalancer(config.BalanceRoundRobin, []string{dead, dead})
+	if _, _, err := r.dial("tcp", lb, client, nil); err == nil {
+		t.Fatal("dial succeeded with no live targets")
+	}
+	if got := r.stats.dialFailures.Load(); got != 3 {
+		t.Fatalf("dial failures = %d, want 3", got)
+	}
+}
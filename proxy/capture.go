@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+const (
+	defaultCaptureMB      = 100
+	defaultCaptureSeconds = 600
+)
+
+var ErrNotCapturing = errors.New("rule not capturing")
+
+// ruleTap 规则转发数据的旁路:抓包和调试日志,抓包由Manager在规则重启时交给新的规则
+type ruleTap struct {
+	capture atomic.Pointer[capture]
+	dump    int  // 调试日志记录每条连接每个方向的前dump字节,0为关闭
+	text    bool // 调试日志输出可打印文本而不是hexdump
+}
+
+// active 是否有旁路需要数据内容
+func (tp *ruleTap) active() bool {
+	if tp.dump > 0 {
+		return true
+	}
+	c := tp.capture.Load()
+	return c != nil && !c.isStopped()
+}
+
+// capture 把规则转发的数据合成为报文写入pcapng文件,超过大小或时长后自动停止。
+// 写文件时持有锁,所有连接的报文按到达顺序写入
+type capture struct {
+	path string
+	max  int64
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	buf     []byte
+	flows   map[uint64]*capFlow
+	timer   *time.Timer
+	stopped atomic.Bool
+}
+
+// capFlow 一条连接在抓包文件里的地址和TCP序号
+type capFlow struct {
+	client, target netip.AddrPort
+	tcp            bool
+	seqIn, seqOut  uint32 // 两个方向下一个报文的序号
+}
+
+func newCapture(cfg *config.ProxyConfig) (*capture, error) {
+	mb, sec := cfg.CaptureMB, cfg.CaptureSeconds
+	if mb <= 0 {
+		mb = defaultCaptureMB
+	}
+	if sec <= 0 {
+		sec = defaultCaptureSeconds
+	}
+	dir := filepath.Join(config.AppDataDir(), "captures")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.pcapng", cfg.ID, time.Now().Format("20060102-150405")))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &capture{
+		path:  path,
+		max:   int64(mb) << 20,
+		f:     f,
+		w:     bufio.NewWriter(f),
+		flows: make(map[uint64]*capFlow),
+	}
+	n, err := writePcapngHeader(c.w)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.size = int64(n)
+	c.timer = time.AfterFunc(time.Duration(sec)*time.Second, func() {
+		log.Printf("capture %s reached time limit\r\n", c.path)
+		c.stop()
+	})
+	return c, nil
+}
+
+func (c *capture) isStopped() bool {
+	return c.stopped.Load()
+}
+
+// stop 写完缓冲区并关闭文件,可以重复调用
+func (c *capture) stop() error {
+	if c.stopped.Swap(true) {
+		return nil
+	}
+	c.timer.Stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.w.Flush()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	c.flows = nil
+	return err
+}
+
+// flow 返回连接的抓包状态,第一次出现时为TCP连接补上三次握手;在c.mu内调用
+func (c *capture) flow(t *tracked, now time.Time) *capFlow {
+	if f, ok := c.flows[t.id]; ok {
+		return f
+	}
+	f := &capFlow{tcp: t.protocol != "udp", seqIn: rand.Uint32(), seqOut: rand.Uint32()}
+	f.client, f.target = flowAddrs(t.clientAddr, t.peerAddr)
+	c.flows[t.id] = f
+	if f.tcp {
+		c.packet(now, buildPacket(f.client, f.target, 6, f.seqIn, 0, tcpSYN, nil))
+		c.packet(now, buildPacket(f.target, f.client, 6, f.seqOut, f.seqIn+1, tcpSYN|tcpACK, nil))
+		f.seqIn++
+		f.seqOut++
+		c.packet(now, buildPacket(f.client, f.target, 6, f.seqIn, f.seqOut, tcpACK, nil))
+	}
+	return f
+}
+
+// write 记录一个方向转发的数据,in为客户端->目标
+func (c *capture) write(t *tracked, in bool, data []byte) {
+	if c.isStopped() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flows == nil {
+		return
+	}
+	now := time.Now()
+	f := c.flow(t, now)
+	src, dst, seq, ack := f.client, f.target, &f.seqIn, f.seqOut
+	if !in {
+		src, dst, seq, ack = f.target, f.client, &f.seqOut, f.seqIn
+	}
+	for len(data) > 0 {
+		n := min(len(data), pcapngMaxData)
+		if f.tcp {
+			c.packet(now, buildPacket(src, dst, 6, *seq, ack, tcpPSH|tcpACK, data[:n]))
+			*seq += uint32(n)
+		} else {
+			// UDP报文不拆分,超长部分截掉
+			c.packet(now, buildPacket(src, dst, 17, 0, 0, 0, data[:n]))
+			break
+		}
+		data = data[n:]
+	}
+}
+
+// closeFlow 连接结束时为TCP连接补上FIN
+func (c *capture) closeFlow(t *tracked) {
+	if c.isStopped() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.flows[t.id]
+	if !ok {
+		return
+	}
+	delete(c.flows, t.id)
+	if f.tcp {
+		now := time.Now()
+		c.packet(now, buildPacket(f.client, f.target, 6, f.seqIn, f.seqOut, tcpFIN|tcpACK, nil))
+		c.packet(now, buildPacket(f.target, f.client, 6, f.seqOut, f.seqIn+1, tcpFIN|tcpACK, nil))
+		c.packet(now, buildPacket(f.client, f.target, 6, f.seqIn+1, f.seqOut+1, tcpACK, nil))
+	}
+}
+
+// packet 写入一个报文,超过大小限制时停止抓包;在c.mu内调用
+func (c *capture) packet(ts time.Time, pkt []byte) {
+	if c.flows == nil {
+		return
+	}
+	c.buf = appendPcapngPacket(c.buf[:0], ts, pkt)
+	if c.size+int64(len(c.buf)) > c.max {
+		log.Printf("capture %s reached size limit\r\n", c.path)
+		c.stopped.Store(true)
+		c.timer.Stop()
+		c.w.Flush()
+		c.f.Close()
+		c.flows = nil
+		return
+	}
+	if _, err := c.w.Write(c.buf); err != nil {
+		log.Printf("capture %s write err: %v\r\n", c.path, err)
+	}
+	c.size += int64(len(c.buf))
+}
+
+// flowAddrs 把两端地址转换成同一协议族,无法解析的地址用0.0.0.0或::代替
+func flowAddrs(client, target net.Addr) (netip.AddrPort, netip.AddrPort) {
+	a, b := toAddrPort(client), toAddrPort(target)
+	if a.Addr().Is4() && b.Addr().Is4() {
+		return a, b
+	}
+	return netip.AddrPortFrom(netip.AddrFrom16(a.Addr().As16()), a.Port()),
+		netip.AddrPortFrom(netip.AddrFrom16(b.Addr().As16()), b.Port())
+}
+
+func toAddrPort(addr net.Addr) netip.AddrPort {
+	if addr != nil {
+		if ip, port := addrIPPort(addr); ip != nil {
+			if a, ok := netip.AddrFromSlice(ip); ok {
+				return netip.AddrPortFrom(a.Unmap(), uint16(port))
+			}
+		}
+		if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+			return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+		}
+	}
+	return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+}
+
+// tapping 连接开始转发时是否需要数据内容,需要时不能splice
+func (t *tracked) tapping() bool {
+	return t.tap != nil && t.tap.active()
+}
+
+// tapIn 客户端->目标转发的数据
+func (t *tracked) tapIn(b []byte) {
+	t.tapData(true, b)
+}
+
+// tapOut 目标->客户端转发的数据
+func (t *tracked) tapOut(b []byte) {
+	t.tapData(false, b)
+}
+
+func (t *tracked) tapData(in bool, b []byte) {
+	if t.tap == nil {
+		return
+	}
+	if t.tap.dump > 0 {
+		t.dump(in, b)
+	}
+	if c := t.tap.capture.Load(); c != nil {
+		c.write(t, in, b)
+	}
+}
+
+// untap 连接结束
+func (t *tracked) untap() {
+	if t.tap == nil {
+		return
+	}
+	if c := t.tap.capture.Load(); c != nil {
+		c.closeFlow(t)
+	}
+}
+
+// StartCapture 开始把规则转发的数据写入pcapng文件,返回文件路径。
+// 已经在splice零拷贝转发的连接抓不到,之后的新连接都会记录
+func (m *Manager) StartCapture(cfg *config.ProxyConfig) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.captures[cfg.ID]; ok && !c.isStopped() {
+		return c.path, nil
+	}
+	c, err := newCapture(cfg)
+	if err != nil {
+		return "", err
+	}
+	m.captures[cfg.ID] = c
+	if r, ok := m.rules[cfg.ID]; ok {
+		r.tap.capture.Store(c)
+	}
+	log.Printf("capture %s started\r\n", c.path)
+	return c.path, nil
+}
+
+// StopCapture 停止规则的抓包
+func (m *Manager) StopCapture(id string) error {
+	m.mu.Lock()
+	c, ok := m.captures[id]
+	delete(m.captures, id)
+	if r, running := m.rules[id]; running {
+		r.tap.capture.Store(nil)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s: %w", id, ErrNotCapturing)
+	}
+	log.Printf("capture %s stopped\r\n", c.path)
+	return c.stop()
+}
+
+// Capturing 规则是否正在抓包,达到大小或时长限制后返回false
+func (m *Manager) Capturing(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.captures[id]
+	return ok && !c.isStopped()
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const connectHeaderTimeout = 10 * time.Second
+
+// serveConnect 处理HTTP CONNECT代理请求,建立隧道后和静态TCP规则一样转发
+func (r *rule) serveConnect(c net.Conn, client net.Addr, t *tracked) {
+	c.SetReadDeadline(time.Now().Add(connectHeaderTimeout))
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		log.Printf("HTTP-CONNECT read request from %s err: %v\r\n", client, err)
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	if req.Method != http.MethodConnect {
+		connectReply(c, http.StatusMethodNotAllowed, "Allow: CONNECT\r\n")
+		return
+	}
+	if r.cfg.ProxyUser != "" && !r.connectAuth(req) {
+		log.Printf("HTTP-CONNECT %s err: proxy authentication failed\r\n", client)
+		connectReply(c, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"proxy\"\r\n")
+		return
+	}
+	host, portStr, err := net.SplitHostPort(req.Host)
+	port, _ := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		connectReply(c, http.StatusBadRequest, "")
+		return
+	}
+
+	dst, err := r.dialDest(t, strings.Trim(host, "[]"), port)
+	if err != nil {
+		connectReply(c, connectStatus(err), "")
+		return
+	}
+	defer dst.Close()
+	if _, err := c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	// 客户端可能在收到应答前就发送了隧道数据
+	if n := br.Buffered(); n > 0 {
+		rest, _ := br.Peek(n)
+		if _, err := dst.Write(rest); err != nil {
+			return
+		}
+		t.tapIn(rest)
+		t.addIn(int64(n))
+	}
+	relay(c, dst, r.tcpTimeout(), r.writeTimeout(), t, r.shapeChunk())
+}
+
+// connectAuth 检查Proxy-Authorization中的Basic认证
+func (r *rule) connectAuth(req *http.Request) bool {
+	auth, ok := strings.CutPrefix(req.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(raw), ":")
+	return ok && r.checkProxyAuth(user, pass)
+}
+
+// connectReply 发送错误应答,之后关闭连接
+func connectReply(c net.Conn, code int, header string) {
+	fmt.Fprintf(c, "HTTP/1.1 %d %s\r\n%sConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code), header)
+}
+
+func connectStatus(err error) int {
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, errDestDenied):
+		return http.StatusForbidden
+	case errors.As(err, &opErr) && opErr.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
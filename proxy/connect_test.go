@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+func TestServeConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	target := echo.Addr().String()
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")) + "\r\n"
+
+	for _, tc := range []struct {
+		name   string
+		user   string
+		req    string
+		status int
+		echo   string // 隧道建立后应当回显的数据,包括和请求一起发来的数据
+	}{
+		{name: "tunnel", req: "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\nhello", status: 200, echo: "hello"},
+		{name: "auth", user: "user", req: "CONNECT " + target + " HTTP/1.1\r\n" + auth + "\r\n", status: 200},
+		{name: "no auth", user: "user", req: "CONNECT " + target + " HTTP/1.1\r\n\r\n", status: 407},
+		{name: "wrong auth", user: "other", req: "CONNECT " + target + " HTTP/1.1\r\n" + auth + "\r\n", status: 407},
+		{name: "get", req: "GET http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\n\r\n", status: 405},
+		{name: "no port", req: "CONNECT example.com HTTP/1.1\r\n\r\n", status: 400},
+		{name: "bad port", req: "CONNECT 127.0.0.1:0 HTTP/1.1\r\n\r\n", status: 400},
+		{name: "denied", req: "CONNECT 192.0.2.1:443 HTTP/1.1\r\n\r\n", status: 403},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRule(&config.ProxyConfig{Protocol: "http-connect", ProxyUser: tc.user, ProxyPass: "pass"})
+			r.allowDest = newDestFilter([]string{"127.0.0.1"})
+			client, server := tcpPair(t)
+			tr := r.open(server.RemoteAddr(), "", server)
+			go func() {
+				r.serveConnect(server, server.RemoteAddr(), tr)
+				server.Close()
+			}()
+			if _, err := io.WriteString(client, tc.req); err != nil {
+				t.Fatal(err)
+			}
+			br := bufio.NewReader(client)
+			resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+			if tc.status != 200 {
+				return
+			}
+			if _, err := io.WriteString(client, "world"); err != nil {
+				t.Fatal(err)
+			}
+			client.(*net.TCPConn).CloseWrite()
+			got, _ := io.ReadAll(br)
+			if want := tc.echo + "world"; string(got) != want {
+				t.Errorf("tunnel echoed %q, want %q", got, want)
+			}
+		})
+	}
+}
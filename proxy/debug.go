@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"log"
+	"strings"
+)
+
+// dump 记录一个方向最开始的数据,每个方向最多tap.dump字节;in为客户端->目标
+func (t *tracked) dump(in bool, b []byte) {
+	done := &t.dumpedOut
+	arrow := "<-"
+	if in {
+		done, arrow = &t.dumpedIn, "->"
+	}
+	left := t.tap.dump - *done
+	if left <= 0 {
+		return
+	}
+	b = b[:min(len(b), left)]
+	*done += len(b)
+	var text string
+	if t.tap.text {
+		text = printable(b)
+	} else {
+		text = strings.TrimSuffix(hex.Dump(b), "\n")
+	}
+	log.Printf("%s #%d %s %s %s %d bytes\r\n%s\r\n", strings.ToUpper(t.protocol), t.id, t.client, arrow, t.targetAddr(), len(b),
+		strings.ReplaceAll(text, "\n", "\r\n"))
+}
+
+// printable 可打印字符原样输出,其他字节显示为'.',保留换行
+func printable(b []byte) string {
+	var sb strings.Builder
+	sb.Grow(len(b))
+	for _, c := range b {
+		if c == '\n' || c == '\t' || (c >= 0x20 && c < 0x7f) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteByte('.')
+		}
+	}
+	return sb.String()
+}
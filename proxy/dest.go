@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errDestDenied = errors.New("destination not allowed")
+
+// destFilter 客户端指定目标的协议(socks5/http-connect)使用的目标允许列表
+type destFilter struct {
+	nets  []*net.IPNet
+	hosts []string // 小写主机名,可以是 *.example.com
+}
+
+// newDestFilter 解析允许列表,每项是CIDR、IP或主机名;列表为空时返回nil,表示不限制
+func newDestFilter(list []string) *destFilter {
+	var f destFilter
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if n := parseNet(v); n != nil {
+			f.nets = append(f.nets, n)
+		} else {
+			f.hosts = append(f.hosts, strings.ToLower(v))
+		}
+	}
+	if len(f.nets) == 0 && len(f.hosts) == 0 {
+		return nil
+	}
+	return &f
+}
+
+func (f *destFilter) ipAllowed(ip net.IP) bool {
+	return containsIP(f.nets, ip)
+}
+
+func (f *destFilter) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range f.hosts {
+		if hostRank(pattern, host) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDest 检查客户端指定的目标,返回实际连接的地址。
+// 主机名在允许列表中时按主机名连接,否则解析后连接第一个允许的IP
+func (r *rule) resolveDest(host string, port int) (string, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	f := r.allowDest
+	if f == nil {
+		return addr, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if f.ipAllowed(ip) {
+			return addr, nil
+		}
+		return "", errDestDenied
+	}
+	if f.hostAllowed(host) {
+		return addr, nil
+	}
+	ctx := context.Background()
+	if timeout := r.dialTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if f.ipAllowed(ip.IP) {
+			return net.JoinHostPort(ip.IP.String(), strconv.Itoa(port)), nil
+		}
+	}
+	return "", errDestDenied
+}
+
+// dialDest 检查并连接客户端请求的目标,按请求的 host:port 统计流量,成功时把连接挂到t上
+func (r *rule) dialDest(t *tracked, host string, port int) (net.Conn, error) {
+	name := strings.ToUpper(r.cfg.Protocol)
+	req := net.JoinHostPort(host, strconv.Itoa(port))
+	addr, err := r.resolveDest(host, port)
+	if err != nil {
+		t.setTarget(req)
+		t.setReason(closeDial)
+		log.Printf("%s %s -> %s err: %v\r\n", name, t.client, req, err)
+		return nil, err
+	}
+	d := r.trackDest(t, req)
+	dst, err := net.DialTimeout("tcp", addr, r.dialTimeout())
+	if err != nil {
+		t.setTarget(addr)
+		t.setReason(closeDial)
+		r.stats.dialFailures.Add(1)
+		d.dialFailures.Add(1)
+		log.Printf("%s %s connect %s err: %v\r\n", name, t.client, addr, err)
+		return nil, err
+	}
+	if !r.attach(t, dst, addr) {
+		dst.Close()
+		return nil, net.ErrClosed
+	}
+	return dst, nil
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+const (
+	HEALTH_INTERVAL = 10 * time.Second // 默认健康检查间隔
+	healthWorkers   = 16               // 同时进行的检查数,端口范围规则的目标可能很多
+)
+
+// Health 规则目标的整体健康状态
+type Health int
+
+const (
+	HealthUnknown  Health = iota // 没有开启健康检查或还没有结果
+	HealthUp                     // 全部目标健康
+	HealthDegraded               // 部分目标不健康
+	HealthDown                   // 全部目标不健康
+)
+
+func (r *rule) healthInterval() time.Duration {
+	if r.cfg.HealthInterval > 0 {
+		return time.Duration(r.cfg.HealthInterval) * time.Second
+	}
+	return HEALTH_INTERVAL
+}
+
+// healthLoop 定期检查规则的全部目标,直到规则停止
+func (r *rule) healthLoop() {
+	ticker := time.NewTicker(r.healthInterval())
+	defer ticker.Stop()
+	for {
+		r.checkAll()
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *rule) checkAll() {
+	sem := make(chan struct{}, healthWorkers)
+	var wg sync.WaitGroup
+	for _, lb := range r.balancers {
+		for _, b := range lb.backends {
+			select {
+			case <-r.done:
+				wg.Wait()
+				return
+			case sem <- struct{}{}:
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.checkBackend(b)
+				<-sem
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// checkBackend 检查一个目标,状态变化时记录日志
+func (r *rule) checkBackend(b *backend) {
+	err := r.probe(b.addr)
+	wasDown := b.down.Swap(err != nil)
+	first := !b.checked.Swap(true)
+	if err != nil && (first || !wasDown) {
+		log.Printf("health check %s %s down: %v\r\n", r.cfg.HealthCheck, b.addr, err)
+	} else if err == nil && wasDown {
+		log.Printf("health check %s %s up\r\n", r.cfg.HealthCheck, b.addr)
+	}
+}
+
+// probe 按规则的设置连接目标:开启SendProxy时先发PROXY头,TargetTLS时完成TLS握手
+func (r *rule) probe(addr string) error {
+	timeout := r.dialTimeout()
+	if timeout <= 0 {
+		timeout = DIAL_TIMEOUT
+	}
+	switch r.cfg.HealthCheck {
+	case config.HealthUDP:
+		// UDP的PROXY头在每个报文前面
+		req := append(r.healthHeader("udp"), unescape(r.cfg.HealthSend)...)
+		return probeUDP(addr, req, r.cfg.HealthExpect, timeout)
+	case config.HealthHTTP:
+		dial := func(context.Context, string, string) (net.Conn, error) {
+			return r.dialBackend("tcp", addr, r.healthHeader("tcp"), timeout)
+		}
+		return probeHTTP(addr, r.cfg.HealthSend, r.cfg.HealthExpect, timeout, dial)
+	default:
+		c, err := r.dialBackend("tcp", addr, r.healthHeader("tcp"), timeout)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+}
+
+// healthHeader 健康检查发送的PROXY头,没有真实客户端:v1为UNKNOWN,v2为LOCAL命令
+func (r *rule) healthHeader(network string) []byte {
+	hdr := r.proxyHeader(network, nil, nil)
+	if bytes.HasPrefix(hdr, proxyV2Sig) {
+		hdr[12] = 0x20 // 版本2,LOCAL命令
+	}
+	return hdr
+}
+
+// probeUDP 发送请求并等待响应;expect为空时收到任何响应都算健康
+func probeUDP(addr string, req []byte, expect string, timeout time.Duration) error {
+	c, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	buf := make([]byte, 64*1024)
+	n, err := c.Read(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(buf[:n], unescape(expect)) {
+		return errors.New("unexpected response")
+	}
+	return nil
+}
+
+// probeHTTP GET请求path,状态码要等于expect,expect为空时要求200;dial建立到目标的连接
+func probeHTTP(addr, path, expect string, timeout time.Duration, dial func(context.Context, string, string) (net.Conn, error)) error {
+	want := http.StatusOK
+	if expect != "" {
+		want, _ = strconv.Atoi(expect)
+	}
+	if path == "" || path[0] != '/' {
+		path = "/" + path
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DisableKeepAlives: true, DialContext: dial},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get("http://" + addr + path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != want {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// unescape 支持\x00这样的转义,方便填写二进制请求
+func unescape(s string) []byte {
+	if u, err := strconv.Unquote(`"` + s + `"`); err == nil {
+		return []byte(u)
+	}
+	return []byte(s)
+}
+
+// health 汇总规则全部目标的健康状态
+func (r *rule) health() Health {
+	if r.cfg.HealthCheck == "" {
+		return HealthUnknown
+	}
+	up, down := 0, 0
+	for _, lb := range r.balancers {
+		for _, b := range lb.backends {
+			if !b.checked.Load() {
+				continue
+			}
+			if b.down.Load() {
+				down++
+			} else {
+				up++
+			}
+		}
+	}
+	switch {
+	case up == 0 && down == 0:
+		return HealthUnknown
+	case down == 0:
+		return HealthUp
+	case up == 0:
+		return HealthDown
+	}
+	return HealthDegraded
+}
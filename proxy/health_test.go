@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// serveTCP 在本地端口上用handle处理每个连接
+func serveTCP(t *testing.T, handle func(c net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveUDP 把handle的返回值作为响应,返回nil时不响应
+func serveUDP(t *testing.T, handle func(req []byte) []byte) string {
+	t.Helper()
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if resp := handle(buf[:n]); resp != nil {
+				c.WriteToUDP(resp, addr)
+			}
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+// deadAddr 没有监听的本地端口
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+// localHeader 检查健康检查发来的是没有客户端地址的PROXY头,返回头后面的数据
+func localHeader(data []byte) ([]byte, bool) {
+	if rest, ok := bytes.CutPrefix(data, []byte("PROXY UNKNOWN\r\n")); ok {
+		return rest, true
+	}
+	if len(data) < 16 || !bytes.HasPrefix(data, proxyV2Sig) || data[12] != 0x20 {
+		return nil, false
+	}
+	n := 16 + int(binary.BigEndian.Uint16(data[14:16]))
+	if len(data) < n {
+		return nil, false
+	}
+	return data[n:], true
+}
+
+// httpBackend 读取PROXY头(hdr为true时)后返回status的HTTP服务
+func httpBackend(t *testing.T, hdr bool, status int) string {
+	return serveTCP(t, func(c net.Conn) {
+		var r io.Reader = c
+		if hdr {
+			_, _, rest, err := readProxyHeader(c)
+			if err != nil {
+				return
+			}
+			r = io.MultiReader(bytes.NewReader(rest), c)
+		}
+		if _, err := http.ReadRequest(bufio.NewReader(r)); err != nil {
+			return
+		}
+		resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{"Location": {"/x"}}}
+		resp.Write(c)
+	})
+}
+
+func TestProbe(t *testing.T) {
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tlsSrv.Close()
+	tlsAddr := strings.TrimPrefix(tlsSrv.URL, "https://")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsSrv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cfg     config.ProxyConfig
+		addr    func(t *testing.T) string
+		wantErr bool
+	}{
+		{name: "tcp up", cfg: config.ProxyConfig{HealthCheck: config.HealthTCP},
+			addr: func(t *testing.T) string { return serveTCP(t, func(net.Conn) {}) }},
+		{name: "tcp down", cfg: config.ProxyConfig{HealthCheck: config.HealthTCP}, addr: deadAddr, wantErr: true},
+		{name: "tcp proxy v1", cfg: config.ProxyConfig{HealthCheck: config.HealthTCP, SendProxy: config.ProxyV1},
+			addr: func(t *testing.T) string {
+				return serveTCP(t, func(c net.Conn) {
+					buf := make([]byte, 64)
+					n, _ := io.ReadAtLeast(c, buf, len("PROXY UNKNOWN\r\n"))
+					if rest, ok := localHeader(buf[:n]); !ok || len(rest) != 0 {
+						t.Errorf("probe sent %q", buf[:n])
+					}
+				})
+			}},
+		{name: "tcp proxy v2", cfg: config.ProxyConfig{HealthCheck: config.HealthTCP, SendProxy: config.ProxyV2},
+			addr: func(t *testing.T) string {
+				return serveTCP(t, func(c net.Conn) {
+					buf := make([]byte, 16)
+					if _, err := io.ReadFull(c, buf); err != nil {
+						t.Errorf("read header: %v", err)
+						return
+					}
+					if rest, ok := localHeader(buf); !ok || len(rest) != 0 {
+						t.Errorf("probe sent %x, want a v2 LOCAL header", buf)
+					}
+				})
+			}},
+		{name: "tcp over tls", cfg: config.ProxyConfig{HealthCheck: config.HealthTCP, TargetTLS: true, TargetInsecure: true},
+			addr: func(*testing.T) string { return tlsAddr }},
+		{name: "tcp over tls untrusted", cfg: config.ProxyConfig{HealthCheck: config.HealthTCP, TargetTLS: true},
+			addr: func(*testing.T) string { return tlsAddr }, wantErr: true},
+		{name: "udp expect", cfg: config.ProxyConfig{HealthCheck: config.HealthUDP, HealthSend: `ping\x00`, HealthExpect: "pong"},
+			addr: func(t *testing.T) string {
+				return serveUDP(t, func(req []byte) []byte {
+					if string(req) != "ping\x00" {
+						t.Errorf("probe sent %q", req)
+					}
+					return []byte("..pong..")
+				})
+			}},
+		{name: "udp any response", cfg: config.ProxyConfig{HealthCheck: config.HealthUDP, HealthSend: "ping"},
+			addr: func(t *testing.T) string { return serveUDP(t, func([]byte) []byte { return []byte{0} }) }},
+		{name: "udp wrong response", cfg: config.ProxyConfig{HealthCheck: config.HealthUDP, HealthSend: "ping", HealthExpect: "pong"},
+			addr: func(t *testing.T) string { return serveUDP(t, func([]byte) []byte { return []byte("nope") }) }, wantErr: true},
+		{name: "udp no response", cfg: config.ProxyConfig{HealthCheck: config.HealthUDP, HealthSend: "ping", DialTimeout: 1},
+			addr: func(t *testing.T) string { return serveUDP(t, func([]byte) []byte { return nil }) }, wantErr: true},
+		{name: "udp proxy v2", cfg: config.ProxyConfig{HealthCheck: config.HealthUDP, HealthSend: "ping", SendProxy: config.ProxyV1},
+			addr: func(t *testing.T) string {
+				return serveUDP(t, func(req []byte) []byte {
+					// UDP总是发送v2头
+					if rest, ok := localHeader(req); !ok || string(rest) != "ping" || !bytes.HasPrefix(req, proxyV2Sig) {
+						t.Errorf("probe sent %q", req)
+						return nil
+					}
+					return []byte("pong")
+				})
+			}},
+		{name: "http ok", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP, HealthSend: "healthz"},
+			addr: func(t *testing.T) string { return httpBackend(t, false, http.StatusOK) }},
+		{name: "http wrong status", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP, HealthExpect: "204"},
+			addr: func(t *testing.T) string { return httpBackend(t, false, http.StatusOK) }, wantErr: true},
+		{name: "http redirect not followed", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP, HealthExpect: "302"},
+			addr: func(t *testing.T) string { return httpBackend(t, false, http.StatusFound) }},
+		{name: "http down", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP}, addr: deadAddr, wantErr: true},
+		{name: "http proxy v1", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP, SendProxy: config.ProxyV1},
+			addr: func(t *testing.T) string { return httpBackend(t, true, http.StatusOK) }},
+		{name: "http proxy v2", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP, SendProxy: config.ProxyV2},
+			addr: func(t *testing.T) string { return httpBackend(t, true, http.StatusOK) }},
+		{name: "https insecure", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP, HealthSend: "/healthz", TargetTLS: true, TargetInsecure: true},
+			addr: func(*testing.T) string { return tlsAddr }},
+		{name: "https ca", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP, HealthSend: "/healthz", TargetTLS: true, TargetCA: caFile},
+			addr: func(*testing.T) string { return tlsAddr }},
+		{name: "https wrong path", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP, HealthSend: "/", TargetTLS: true, TargetCA: caFile},
+			addr: func(*testing.T) string { return tlsAddr }, wantErr: true},
+		{name: "https untrusted", cfg: config.ProxyConfig{HealthCheck: config.HealthHTTP, HealthSend: "/healthz", TargetTLS: true},
+			addr: func(*testing.T) string { return tlsAddr }, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.ID, tc.cfg.Protocol = "health", "tcp"
+			r := newTestRule(&tc.cfg)
+			if tc.cfg.TargetTLS {
+				var err error
+				if r.targetTLS, err = clientTLSConfig(&tc.cfg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := r.probe(tc.addr(t))
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("probe err = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestHealthTransitions 目标状态变化后汇总的健康状态跟着变化,被标记为不健康的目标不再被选择
+func TestHealthTransitions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := ln.Addr().String()
+	ln.Close()
+	down := deadAddr(t)
+
+	r := newTestRule(&config.ProxyConfig{ID: "health", Protocol: "tcp", HealthCheck: config.HealthTCP})
+	lb := newBalancer(config.BalanceRoundRobin, []string{up, down})
+	r.balancers = []*balancer{lb}
+	if got := r.health(); got != HealthUnknown {
+		t.Fatalf("before checks: %v, want unknown", got)
+	}
+
+	r.checkAll()
+	if got := r.health(); got != HealthDown {
+		t.Fatalf("all closed: %v, want down", got)
+	}
+
+	// 在同一端口上重新监听,目标恢复
+	ln, err = net.Listen("tcp", up)
+	if err != nil {
+		t.Skipf("relisten %s: %v", up, err)
+	}
+	defer ln.Close()
+	r.checkAll()
+	if got := r.health(); got != HealthDegraded {
+		t.Fatalf("one up: %v, want degraded", got)
+	}
+	if got := order(lb.pick(nil)); len(got) != 1 || got[0] != up {
+		t.Fatalf("pick = %v, want only %s", got, up)
+	}
+
+	lb.backends[1].addr = up
+	r.checkAll()
+	if got := r.health(); got != HealthUp {
+		t.Fatalf("all up: %v, want up", got)
+	}
+
+	r.cfg.HealthCheck = ""
+	if got := r.health(); got != HealthUnknown {
+		t.Fatalf("no health check: %v, want unknown", got)
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// httpHeaderTimeout 客户端发完请求头的超时,避免慢速客户端一直占着连接
+const httpHeaderTimeout = 10 * time.Second
+
+type httpConnKey struct{}
+
+// httpConn 交给http.Server处理的客户端连接,统计流量并在关闭时通知handleTCPConnection
+type httpConn struct {
+	net.Conn
+	client    net.Addr
+	local     net.Addr // 客户端连接的地址,开启AcceptProxy时是PROXY头里的地址
+	rt        *router
+	t         *tracked
+	transport *http.Transport // 这个客户端自己的连接池,nil时用规则共用的
+	once      sync.Once
+	closed    chan struct{}
+}
+
+func (c *httpConn) RemoteAddr() net.Addr {
+	return c.client
+}
+
+func (c *httpConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.t.tapIn(p[:n])
+		c.t.addIn(int64(n))
+		c.t.waitIn(int64(n))
+	}
+	return n, err
+}
+
+func (c *httpConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.t.tapOut(p[:n])
+		c.t.addOut(int64(n))
+		c.t.waitOut(int64(n))
+	}
+	return n, err
+}
+
+func (c *httpConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// connListener 把accept循环中已经处理过的连接交给http.Server,规则停止时返回net.ErrClosed
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error   { return nil }
+func (l *connListener) Addr() net.Addr { return l.addr }
+
+// backendConn 到目标的连接关闭时减少目标的连接数
+type backendConn struct {
+	net.Conn
+	b    *backend
+	once sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(c.b.done)
+	return c.Conn.Close()
+}
+
+// roundTripFunc 按请求所在的客户端连接选择连接池
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (r *rule) newHTTPTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:         r.dialHTTP,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// privateBackendConns 到目标的连接是否只能给一个客户端连接使用:
+// PROXY头里是单个客户端的地址,source-hash要让同一客户端总是用同一目标
+func (r *rule) privateBackendConns() bool {
+	return r.cfg.SendProxy != "" || r.cfg.Balance == config.BalanceSourceHash
+}
+
+// startHTTP 创建http协议使用的反向代理,所有端口的连接共用一个http.Server
+func (r *rule) startHTTP() {
+	r.httpLn = &connListener{addr: &net.TCPAddr{}, conns: make(chan net.Conn), done: r.done}
+	r.httpTransport = r.newHTTPTransport()
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			rt := pr.In.Context().Value(httpConnKey{}).(*httpConn).rt
+			lb := rt.def
+			route := rt.match(hostOnly(pr.In.Host), pr.In.URL.Path)
+			if route != nil {
+				lb = route.lb
+			}
+			// URL里的主机名只用来找到负载均衡器,dialHTTP再按策略选择目标
+			pr.SetURL(&url.URL{Scheme: "http", Host: "lb" + strconv.Itoa(lb.id)})
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			if route != nil && route.strip && route.path != "" {
+				stripPrefix(pr.Out.URL, route.path)
+				pr.Out.Header.Set("X-Forwarded-Prefix", route.path)
+			}
+		},
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			hc := req.Context().Value(httpConnKey{}).(*httpConn)
+			// 记录每个请求实际使用的目标,连接表和访问日志显示最近一次请求的目标
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					if bc, ok := info.Conn.(*backendConn); ok {
+						hc.t.setTarget(bc.b.addr)
+					}
+				},
+			}))
+			if hc.transport != nil {
+				return hc.transport.RoundTrip(req)
+			}
+			return r.httpTransport.RoundTrip(req)
+		}),
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("HTTP proxy %s %s%s err: %v\r\n", req.RemoteAddr, req.Host, req.URL.Path, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	srv := &http.Server{
+		Handler: proxy,
+		// http.Server启动后不能修改,修改TCP空闲超时后http规则要重启才生效
+		IdleTimeout:       r.tcpTimeout(),
+		ReadHeaderTimeout: httpHeaderTimeout,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnKey{}, c.(*httpConn))
+		},
+	}
+	go srv.Serve(r.httpLn)
+}
+
+// serveHTTP 把连接交给http.Server,等待连接关闭
+func (r *rule) serveHTTP(c net.Conn, client, local net.Addr, rt *router, t *tracked) {
+	hc := &httpConn{Conn: c, client: client, local: local, rt: rt, t: t, closed: make(chan struct{})}
+	if r.privateBackendConns() {
+		hc.transport = r.newHTTPTransport()
+		defer hc.transport.CloseIdleConnections()
+	}
+	select {
+	case r.httpLn.conns <- hc:
+	case <-r.done:
+		return
+	}
+	select {
+	case <-hc.closed:
+	case <-r.done:
+	}
+}
+
+// dialHTTP 按URL中的lb编号连接目标,开启SendProxy时发送客户端连接的PROXY头
+func (r *rule) dialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	id, err := strconv.Atoi(strings.TrimPrefix(host, "lb"))
+	if err != nil || id < 0 || id >= len(r.balancers) {
+		return nil, fmt.Errorf("unknown backend %s", addr)
+	}
+	hc, ok := ctx.Value(httpConnKey{}).(*httpConn)
+	if !ok {
+		return nil, fmt.Errorf("no client connection for %s", addr)
+	}
+	c, b, err := r.dial("tcp", r.balancers[id], hc.client, r.proxyHeader("tcp", hc.client, hc.local))
+	if err != nil {
+		return nil, err
+	}
+	return &backendConn{Conn: c, b: b}, nil
+}
+
+// hostOnly 去掉Host头中的端口
+func hostOnly(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// stripPrefix 去掉路径前缀,结果总是以/开头
+func stripPrefix(u *url.URL, prefix string) {
+	trim := func(p string) string {
+		p = strings.TrimPrefix(p, prefix)
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		return p
+	}
+	u.Path = trim(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = trim(u.RawPath)
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// TestHTTPTarget 连接表和访问日志里的目标是最近一次请求实际使用的目标;
+// 开启调试日志时转发协程同时在读目标,用-race检查
+func TestHTTPTarget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.Host)
+	}))
+	defer backend.Close()
+	target := strings.TrimPrefix(backend.URL, "http://")
+
+	r := newTestRule(&config.ProxyConfig{ID: "http", Protocol: "http", ListenAddr: "127.0.0.1",
+		TargetAddr: target, DebugBytes: 16, DebugText: true})
+	r.targets = []string{target}
+	if err := r.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.stop()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.CloseIdleConnections()
+	url := "http://" + r.listeners[0].Addr().String() + "/"
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "127.0.0.1") {
+			t.Fatalf("response %d %q", resp.StatusCode, body)
+		}
+	}
+	conns := r.connTable()
+	if len(conns) != 1 || conns[0].TargetAddr != target {
+		t.Fatalf("conns %v, want one connection to %s", conns, target)
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket 令牌桶,每秒补充rate个令牌,最多存burst个
+type tokenBucket struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	changed chan struct{} // setRate时关闭并换成新的,唤醒正在take中等待的调用
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = max(rate, 1)
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now(), changed: make(chan struct{})}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// setRate 修改速率,欠下的令牌一笔勾销,新速率马上生效
+func (b *tokenBucket) setRate(rate, burst float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if burst < 1 {
+		burst = max(rate, 1)
+	}
+	b.refill(time.Now())
+	if b.rate <= 0 {
+		b.tokens = burst // 之前不限速时没有积累令牌
+	}
+	b.rate, b.burst = rate, burst
+	b.tokens = min(max(b.tokens, 0), burst)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// tryTake 令牌足够时取走n个并返回true;速率为0时不限制
+func (b *tokenBucket) tryTake(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve 预先取走n个令牌,返回需要等待的时间;令牌可以欠着,后来的调用排在后面
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take 取走n个令牌,不够时等待。每次最多预留burst个,一大块数据不会欠下很久的令牌;
+// 等待中速率被修改时按新速率重新预留,done关闭时放弃等待并返回false
+func (b *tokenBucket) take(n float64, done <-chan struct{}) bool {
+	for n > 0 {
+		b.mu.Lock()
+		if b.rate <= 0 {
+			b.mu.Unlock()
+			return true
+		}
+		b.refill(time.Now())
+		part := min(n, b.burst)
+		b.tokens -= part
+		wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+		changed := b.changed
+		b.mu.Unlock()
+		n -= part
+		if wait <= 0 {
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			// setRate勾销了欠下的令牌,这一份按新速率重新预留
+			timer.Stop()
+			n += part
+		case <-done:
+			timer.Stop()
+			return false
+		}
+	}
+	return true
+}
+
+// connLimiter 规则的TCP连接数和接受速率限制,端口范围内的所有端口共用
+type connLimiter struct {
+	slots chan struct{} // 最大并发连接数,nil为不限制
+	perIP int
+	rate  *tokenBucket // 每秒接受的连接数,nil为不限制
+	queue bool         // 超过限制时排队等待,否则直接关闭连接
+
+	mu  sync.Mutex
+	ips map[string]int
+}
+
+// newConnLimiter 没有设置任何限制时返回nil
+func newConnLimiter(maxConns, perIP, rate, burst int, queue bool) *connLimiter {
+	if maxConns <= 0 && perIP <= 0 && rate <= 0 {
+		return nil
+	}
+	l := &connLimiter{perIP: perIP, queue: queue, ips: make(map[string]int)}
+	if maxConns > 0 {
+		l.slots = make(chan struct{}, maxConns)
+	}
+	if rate > 0 {
+		l.rate = newTokenBucket(float64(rate), float64(burst))
+	}
+	return l
+}
+
+// admit 在Accept之后调用,返回false时连接被拒绝;返回true后连接结束时要调用release。
+// 排队模式下并发数和速率超限时阻塞接受循环,新连接留在系统的backlog里;单IP超限总是拒绝。
+// addr为nil时不检查单IP并发数,由调用者在知道真实客户端后调用admitIP
+func (r *rule) admit(l *connLimiter, addr net.Addr) bool {
+	if l.rate != nil {
+		if !l.queue {
+			if !l.rate.tryTake(1) {
+				r.stats.limited.Add(1)
+				return false
+			}
+		} else if wait := l.rate.reserve(1); wait > 0 {
+			r.stats.queued.Add(1)
+			select {
+			case <-time.After(wait):
+			case <-r.done:
+				return false
+			}
+		}
+	}
+	ip := ""
+	if addr != nil {
+		if ip = addrKey(addr); !r.admitIP(l, ip) {
+			return false
+		}
+	}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if !l.queue {
+				l.releaseIP(ip)
+				r.stats.limited.Add(1)
+				return false
+			}
+			r.stats.queued.Add(1)
+			select {
+			case l.slots <- struct{}{}:
+			case <-r.done:
+				l.releaseIP(ip)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// admitIP 检查单IP并发数,返回true后连接结束时要调用releaseIP
+func (r *rule) admitIP(l *connLimiter, ip string) bool {
+	if l.perIP <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ips[ip] >= l.perIP {
+		r.stats.limited.Add(1)
+		return false
+	}
+	l.ips[ip]++
+	return true
+}
+
+// release 归还admit占用的名额,addr要和调用admit时相同
+func (l *connLimiter) release(addr net.Addr) {
+	if l.slots != nil {
+		<-l.slots
+	}
+	if addr != nil {
+		l.releaseIP(addrKey(addr))
+	}
+}
+
+// releaseIP 归还admitIP占用的计数,ip为空表示没有计数
+func (l *connLimiter) releaseIP(ip string) {
+	if l.perIP <= 0 || ip == "" {
+		return
+	}
+	l.mu.Lock()
+	if l.ips[ip]--; l.ips[ip] <= 0 {
+		delete(l.ips, ip)
+	}
+	l.mu.Unlock()
+}
+
+// addrKey 按IP计数时使用的键
+func addrKey(addr net.Addr) string {
+	if ip, _ := addrIPPort(addr); ip != nil {
+		return ip.String()
+	}
+	return addr.String()
+}
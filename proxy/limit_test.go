@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// elapse 让令牌桶以为过去了d
+func (b *tokenBucket) elapse(d time.Duration) {
+	b.mu.Lock()
+	b.last = b.last.Add(-d)
+	b.mu.Unlock()
+}
+
+func TestTokenBucketTryTake(t *testing.T) {
+	b := newTokenBucket(10, 2)
+	for i, want := range []bool{true, true, false} {
+		if got := b.tryTake(1); got != want {
+			t.Fatalf("take %d = %v, want %v", i, got, want)
+		}
+	}
+	b.elapse(100 * time.Millisecond)
+	if !b.tryTake(1) || b.tryTake(1) {
+		t.Fatal("100ms at 10/s should refill exactly one token")
+	}
+	b.elapse(time.Hour)
+	if !b.tryTake(2) || b.tryTake(1) {
+		t.Fatal("refill must stop at burst")
+	}
+	if !newTokenBucket(0, 0).tryTake(1e9) {
+		t.Fatal("rate 0 must not limit")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(10, 1)
+	for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		got := b.reserve(1)
+		if got < want-10*time.Millisecond || got > want+10*time.Millisecond {
+			t.Fatalf("reserve %d waits %v, want about %v", i, got, want)
+		}
+	}
+	// 修改速率时欠下的令牌一笔勾销,不用再等前面预留的300ms
+	b.setRate(10, 1)
+	if got := b.reserve(1); got > 110*time.Millisecond {
+		t.Fatalf("reserve after setRate waits %v, want at most 100ms", got)
+	}
+}
+
+func TestConnLimiterPerIP(t *testing.T) {
+	r := newTestRule(&config.ProxyConfig{})
+	l := newConnLimiter(0, 1, 0, 0, false)
+	a := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	b := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1001}
+	if !r.admit(l, a) {
+		t.Fatal("first connection rejected")
+	}
+	if r.admit(l, b) {
+		t.Fatal("second connection from the same IP admitted")
+	}
+	// 开启AcceptProxy时Accept后不按对端计数,PROXY头里的客户端单独计数
+	if !r.admit(l, nil) || !r.admit(l, nil) {
+		t.Fatal("admit without an address must skip the per-IP limit")
+	}
+	if !r.admitIP(l, "198.51.100.7") || r.admitIP(l, "198.51.100.7") {
+		t.Fatal("per-IP limit not applied to the parsed client")
+	}
+	l.releaseIP("198.51.100.7")
+	l.release(a)
+	if !r.admit(l, b) {
+		t.Fatal("connection rejected after release")
+	}
+	if got := r.stats.limited.Load(); got != 2 {
+		t.Fatalf("limited = %d, want 2", got)
+	}
+}
@@ -0,0 +1,473 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+var (
+	ErrRuleRunning    = errors.New("rule already running")
+	ErrRuleNotRunning = errors.New("rule not running")
+	ErrOpenRelay      = errors.New("socks5/http-connect rule without authentication or allowed destinations must listen on a loopback address")
+)
+
+// Manager 按ID管理每条转发规则,单独启动/停止,互不影响
+type Manager struct {
+	conf  *config.Conf
+	mu    sync.Mutex
+	rules map[string]*rule
+	stats map[string]*ruleStats // 重启规则时保留统计
+	// 正在抓包的规则,重启规则时继续
+	captures map[string]*capture
+	access   *accessLog // 所有规则共用的访问日志
+	// 运行中的规则读取的全局设置,界面修改全局设置后调用SetGlobal替换
+	global atomic.Pointer[globalSettings]
+}
+
+// globalSettings 全局设置的快照,创建后不再修改,规则可以随时读取
+type globalSettings struct {
+	tcpTimeout, udpTimeout, dialTimeout, writeTimeout int
+	acl                                               *ipACL // 全局客户端IP列表,nil为不限制
+}
+
+func newGlobalSettings(conf *config.Conf) *globalSettings {
+	g := &globalSettings{tcpTimeout: conf.TCPTimeout, udpTimeout: conf.UDPTimeout, dialTimeout: conf.DialTimeout,
+		writeTimeout: conf.WriteTimeout}
+	if len(conf.AllowIPs) > 0 || len(conf.DenyIPs) > 0 {
+		g.acl = newIPACL(conf.AllowIPs, conf.DenyIPs)
+	}
+	return g
+}
+
+func NewManager(conf *config.Conf) *Manager {
+	m := &Manager{
+		conf:     conf,
+		rules:    make(map[string]*rule),
+		stats:    make(map[string]*ruleStats),
+		captures: make(map[string]*capture),
+		access:   newAccessLog(filepath.Join(config.AppDataDir(), "access.log")),
+	}
+	m.global.Store(newGlobalSettings(conf))
+	return m
+}
+
+// SetGlobal 修改全局设置后调用,超时和客户端IP列表对运行中的规则马上生效
+func (m *Manager) SetGlobal(conf *config.Conf) {
+	m.global.Store(newGlobalSettings(conf))
+}
+
+// StartAll 启动配置中的全部规则,返回所有失败规则的错误
+func (m *Manager) StartAll() error {
+	m.mu.Lock()
+	configs := slices.Clone(m.conf.Configs)
+	m.mu.Unlock()
+	// 所有规则共用一次查询到的WSL IP
+	wslIP := m.wslIP(configs...)
+	var errs []error
+	for _, v := range configs {
+		if err := m.start(v, wslIP); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StopAll 停止全部规则
+func (m *Manager) StopAll() {
+	m.mu.Lock()
+	rules := m.rules
+	m.rules = make(map[string]*rule)
+	m.mu.Unlock()
+	for _, r := range rules {
+		r.stop()
+	}
+}
+
+// Start 启动单条规则
+func (m *Manager) Start(cfg *config.ProxyConfig) error {
+	return m.start(cfg, m.wslIP(cfg))
+}
+
+// start 启动单条规则,wslIP在加锁前查询,查询期间不阻塞界面读取统计
+func (m *Manager) start(cfg *config.ProxyConfig, wslIP string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rules[cfg.ID]; ok {
+		return fmt.Errorf("%s: %w", cfg.ID, ErrRuleRunning)
+	}
+	stats, ok := m.stats[cfg.ID]
+	if !ok {
+		stats = &ruleStats{}
+		m.stats[cfg.ID] = stats
+	}
+	r := newRule(cfg, &m.global, targetAddrs(cfg.TargetList(), wslIP), stats)
+	r.routes = routeAddrs(cfg.Routes, wslIP)
+	r.access = m.access
+	if c, ok := m.captures[cfg.ID]; ok {
+		r.tap.capture.Store(c)
+	}
+	if err := r.start(); err != nil {
+		cfg.Status = false
+		return err
+	}
+	cfg.Status = true
+	m.rules[cfg.ID] = r
+	return nil
+}
+
+// Stop 停止单条规则,关闭它的监听和所有连接
+func (m *Manager) Stop(id string) error {
+	m.mu.Lock()
+	r, ok := m.rules[id]
+	delete(m.rules, id)
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s: %w", id, ErrRuleNotRunning)
+	}
+	r.stop()
+	return nil
+}
+
+// Restart 用cfg的最新内容重启规则,规则未运行时直接启动;
+// 只修改了带宽限制时直接生效,不断开已有连接
+func (m *Manager) Restart(cfg *config.ProxyConfig) error {
+	m.mu.Lock()
+	r, ok := m.rules[cfg.ID]
+	m.mu.Unlock()
+	if ok && onlyBandwidthChanged(r.config(), cfg) {
+		r.setBandwidth(cfg)
+		return nil
+	}
+	if err := m.Stop(cfg.ID); err != nil && !errors.Is(err, ErrRuleNotRunning) {
+		return err
+	}
+	return m.Start(cfg)
+}
+
+// Add 把规则加入配置并启动
+func (m *Manager) Add(cfg *config.ProxyConfig) error {
+	m.mu.Lock()
+	m.conf.Configs = append(m.conf.Configs, cfg)
+	m.mu.Unlock()
+	return m.Start(cfg)
+}
+
+// Remove 停止规则并从配置中删除
+func (m *Manager) Remove(id string) error {
+	err := m.Stop(id)
+	if errors.Is(err, ErrRuleNotRunning) {
+		err = nil
+	}
+	m.mu.Lock()
+	delete(m.stats, id)
+	c, capturing := m.captures[id]
+	delete(m.captures, id)
+	m.conf.Configs = slices.DeleteFunc(m.conf.Configs, func(c *config.ProxyConfig) bool { return c.ID == id })
+	m.mu.Unlock()
+	if capturing {
+		c.stop()
+	}
+	return err
+}
+
+// Stats 返回规则的流量统计
+func (m *Manager) Stats(id string) Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.stats[id]; ok {
+		return s.snapshot()
+	}
+	return Stats{}
+}
+
+// DestStats 返回socks5/http-connect规则按目标的流量统计
+func (m *Manager) DestStats(id string) []DestStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.stats[id]; ok {
+		return s.destSnapshot()
+	}
+	return nil
+}
+
+// Health 返回规则目标的健康状态,规则没有运行时为HealthUnknown
+func (m *Manager) Health(id string) Health {
+	m.mu.Lock()
+	r, ok := m.rules[id]
+	m.mu.Unlock()
+	if !ok {
+		return HealthUnknown
+	}
+	return r.health()
+}
+
+// Conns 返回规则当前的连接表
+func (m *Manager) Conns(id string) []ConnInfo {
+	m.mu.Lock()
+	r, ok := m.rules[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return r.connTable()
+}
+
+// UDPSessions 返回UDP规则当前的会话表
+func (m *Manager) UDPSessions(id string) []ConnInfo {
+	m.mu.Lock()
+	r, ok := m.rules[id]
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	var list []ConnInfo
+	for _, tb := range r.udps {
+		list = append(list, tb.list()...)
+	}
+	return list
+}
+
+// wslIP 开启AutoUseWslIp且有规则的目标是127.0.0.1时查询WSL的IP,否则返回空;
+// 每次查询都会启动wsl进程,不能在持有m.mu时调用
+func (m *Manager) wslIP(configs ...*config.ProxyConfig) string {
+	m.mu.Lock()
+	auto := m.conf.AutoUseWslIp
+	m.mu.Unlock()
+	if !auto || !slices.ContainsFunc(configs, usesLoopbackTarget) {
+		return ""
+	}
+	// hostname -I 可能返回多个IP,取第一个
+	if ips := strings.Fields(config.GetWslIP()); len(ips) > 0 {
+		return ips[0]
+	}
+	return ""
+}
+
+// usesLoopbackTarget 规则的目标或路由目标中是否有127.0.0.1
+func usesLoopbackTarget(cfg *config.ProxyConfig) bool {
+	addrs := cfg.TargetList()
+	for _, route := range cfg.Routes {
+		addrs = append(addrs, route.Target)
+	}
+	return slices.ContainsFunc(addrs, isLoopbackTarget)
+}
+
+func isLoopbackTarget(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && host == "127.0.0.1"
+}
+
+// targetAddrs 把目标中的127.0.0.1替换成WSL的IP,wslIP为空时不替换
+func targetAddrs(addrs []string, wslIP string) []string {
+	if wslIP == "" {
+		return addrs
+	}
+	for i, addr := range addrs {
+		if isLoopbackTarget(addr) {
+			_, port, _ := net.SplitHostPort(addr)
+			addrs[i] = net.JoinHostPort(wslIP, port)
+		}
+	}
+	return addrs
+}
+
+// rule 一条正在运行的转发规则
+type rule struct {
+	cfg        config.ProxyConfig // 启动时的配置快照
+	global     *atomic.Pointer[globalSettings]
+	family     string // 监听的协议族: "4" "6",双栈为空
+	listenHost string
+	targets    []string // 第一个端口对应的目标地址
+	routes     []config.Route
+
+	// 端口范围的每个端口各有一个监听
+	listeners []net.Listener
+	udpConns  []*net.UDPConn
+	udps      []*udpTable
+	balancers []*balancer   // 每个监听端口和每条路由一个,健康检查使用
+	tlsConf   *tls.Config   // tls协议监听使用
+	targetTLS *tls.Config   // 用TLS连接目标时使用
+	allowDest *destFilter   // socks5/http-connect协议的目标允许列表,nil为不限制
+	acl       *ipACL        // 规则自己的客户端IP列表,nil时使用全局列表
+	limiter   *connLimiter  // TCP连接数和接受速率限制,nil为不限制
+	shaper    *shaper       // 带宽限制,运行中可以修改
+	tap       *ruleTap      // 抓包等需要转发数据内容的旁路
+	access    *accessLog    // 连接结束时写访问日志,nil为不写
+	done      chan struct{} // 规则停止时关闭
+
+	// http协议的反向代理
+	httpLn        *connListener
+	httpTransport *http.Transport
+
+	stats  *ruleStats
+	mu     sync.Mutex
+	conns  map[uint64]*tracked
+	closed bool
+}
+
+func newRule(cfg *config.ProxyConfig, global *atomic.Pointer[globalSettings], targets []string, stats *ruleStats) *rule {
+	return &rule{
+		cfg:     *cfg.Clone(),
+		global:  global,
+		targets: targets,
+		done:    make(chan struct{}),
+		shaper:  newShaper(cfg),
+		tap:     &ruleTap{dump: cfg.DebugBytes, text: cfg.DebugText},
+		stats:   stats,
+		conns:   make(map[uint64]*tracked),
+	}
+}
+
+// listenHost 根据ListenAddr得到监听的协议族和IP,双栈时IP为空
+func listenHost(cfg *config.ProxyConfig) (family, host string, err error) {
+	host = cfg.ListenHost()
+	if host == config.DualStack {
+		return "", "", nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", "", fmt.Errorf("invalid listen address %q", cfg.ListenAddr)
+	}
+	family = "6"
+	if ip.To4() != nil {
+		family = "4"
+	}
+	return family, ip.String(), nil
+}
+
+// offsetAddr 把host:port的端口加上offset,用于端口范围一一对应
+func offsetAddr(addr string, offset int) (string, error) {
+	if offset == 0 {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n+offset)), nil
+}
+
+// start 监听端口范围内的每个端口,任一端口失败时关闭已经启动的监听
+func (r *rule) start() error {
+	err := r.listenAll()
+	if err != nil {
+		r.closeListeners()
+		return err
+	}
+	// 客户端指定目标的协议没有固定目标可以检查
+	if r.cfg.HealthCheck != "" && !r.cfg.Dynamic() {
+		go r.healthLoop()
+	}
+	return nil
+}
+
+func (r *rule) listenAll() error {
+	var err error
+	r.family, r.listenHost, err = listenHost(&r.cfg)
+	if err != nil {
+		log.Printf("%s proxy -> %s err:%v\r\n", strings.ToUpper(r.cfg.Protocol), r.cfg.TargetRange(), err)
+		return err
+	}
+	if !slices.Contains(config.Protocols, r.cfg.Protocol) {
+		return fmt.Errorf("unknown protocol %q", r.cfg.Protocol)
+	}
+	if r.cfg.OpenRelay() {
+		log.Printf("%s proxy %s err:%v\r\n", strings.ToUpper(r.cfg.Protocol), r.cfg.BindAddr(), ErrOpenRelay)
+		return ErrOpenRelay
+	}
+	if r.cfg.Protocol == "tls" {
+		if r.tlsConf, err = serverTLSConfig(&r.cfg); err != nil {
+			log.Printf("TLS proxy %s -> %s load cert err:%v\r\n", r.cfg.BindAddr(), r.cfg.TargetRange(), err)
+			return err
+		}
+	}
+	if r.cfg.Protocol == "http" {
+		r.startHTTP()
+	}
+	r.allowDest = newDestFilter(r.cfg.AllowDest)
+	if len(r.cfg.AllowIPs) > 0 || len(r.cfg.DenyIPs) > 0 {
+		r.acl = newIPACL(r.cfg.AllowIPs, r.cfg.DenyIPs)
+	}
+	r.limiter = newConnLimiter(r.cfg.MaxConns, r.cfg.MaxConnsPerIP, r.cfg.AcceptRate, r.cfg.AcceptBurst, r.cfg.QueueConns)
+	if r.cfg.TargetTLS && r.cfg.Transport() == "tcp" {
+		if r.targetTLS, err = clientTLSConfig(&r.cfg); err != nil {
+			log.Printf("%s proxy %s -> %s load target tls err:%v\r\n", strings.ToUpper(r.cfg.Protocol), r.cfg.BindAddr(), r.cfg.TargetRange(), err)
+			return err
+		}
+	}
+	for i := 0; i < r.cfg.PortCount(); i++ {
+		listenAddr := net.JoinHostPort(r.listenHost, strconv.Itoa(r.cfg.ListenPort+i))
+		addrs := make([]string, len(r.targets))
+		for j, target := range r.targets {
+			if addrs[j], err = offsetAddr(target, i); err != nil {
+				log.Printf("%s proxy %s -> %s err:%v\r\n", strings.ToUpper(r.cfg.Protocol), listenAddr, target, err)
+				return err
+			}
+		}
+		lb := r.addBalancer(newBalancer(r.cfg.Balance, addrs))
+		if r.cfg.Transport() == "tcp" {
+			var rt *router
+			if rt, err = r.newRouter(lb, i); err != nil {
+				log.Printf("%s proxy %s route err:%v\r\n", strings.ToUpper(r.cfg.Protocol), listenAddr, err)
+				return err
+			}
+			err = r.startTCP(listenAddr, rt)
+		} else {
+			err = r.startUDP(listenAddr, lb)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addBalancer 登记负载均衡器,健康检查和http协议按序号使用
+func (r *rule) addBalancer(lb *balancer) *balancer {
+	lb.id = len(r.balancers)
+	r.balancers = append(r.balancers, lb)
+	return lb
+}
+
+func (r *rule) closeListeners() {
+	for _, l := range r.listeners {
+		l.Close()
+	}
+	for _, c := range r.udpConns {
+		c.Close()
+	}
+}
+
+func (r *rule) stop() {
+	close(r.done)
+	r.closeListeners()
+	if r.httpTransport != nil {
+		r.httpTransport.CloseIdleConnections()
+	}
+	r.mu.Lock()
+	r.closed = true
+	for _, t := range r.conns {
+		t.setReason(closeStopped)
+		for _, c := range t.conns {
+			c.Close()
+		}
+	}
+	r.mu.Unlock()
+	log.Printf("%s proxy %s -> %s stopped\r\n", strings.ToUpper(r.cfg.Protocol), r.cfg.BindAddr(), r.cfg.TargetRange())
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+func TestTargetAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   config.ProxyConfig
+		local bool     // 是否需要查询WSL的IP
+		want  []string // 替换成192.0.2.10后的目标
+	}{
+		{name: "loopback", cfg: config.ProxyConfig{TargetAddr: "127.0.0.1:80", Targets: []string{"10.0.0.1:80"}},
+			local: true, want: []string{"192.0.2.10:80", "10.0.0.1:80"}},
+		{name: "remote", cfg: config.ProxyConfig{TargetAddr: "10.0.0.1:80"}, want: []string{"10.0.0.1:80"}},
+		{name: "localhost name", cfg: config.ProxyConfig{TargetAddr: "localhost:80"}, want: []string{"localhost:80"}},
+		{name: "route", cfg: config.ProxyConfig{Protocol: "http", TargetAddr: "10.0.0.1:80",
+			Routes: []config.Route{{Host: "a.example", Target: "127.0.0.1:8080"}}}, local: true, want: []string{"10.0.0.1:80"}},
+		{name: "dynamic", cfg: config.ProxyConfig{Protocol: "socks5"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := usesLoopbackTarget(&tc.cfg); got != tc.local {
+				t.Errorf("usesLoopbackTarget = %v, want %v", got, tc.local)
+			}
+			if got := targetAddrs(tc.cfg.TargetList(), "192.0.2.10"); !slices.Equal(got, tc.want) {
+				t.Errorf("targetAddrs = %v, want %v", got, tc.want)
+			}
+		})
+	}
+	routes := routeAddrs([]config.Route{{Host: "a.example", Target: "127.0.0.1:8080"}}, "192.0.2.10")
+	if routes[0].Target != "192.0.2.10:8080" || routes[0].Host != "a.example" {
+		t.Errorf("routeAddrs = %+v", routes)
+	}
+	if got := targetAddrs([]string{"127.0.0.1:80"}, ""); got[0] != "127.0.0.1:80" {
+		t.Errorf("replaced without a WSL IP: %v", got)
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// pcapng块类型和链路类型,只写一个LINKTYPE_RAW接口,IPv4和IPv6报文都可以放进去
+const (
+	pcapngSHB     = 0x0A0D0D0A
+	pcapngIDB     = 0x00000001
+	pcapngEPB     = 0x00000006
+	linkTypeRaw   = 101
+	pcapngMaxData = 32 * 1024 // 每个合成报文最多携带的数据,超过时拆成多个报文
+)
+
+// writePcapngHeader 写入Section Header Block和Interface Description Block
+func writePcapngHeader(w io.Writer) (int, error) {
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, pcapngSHB)
+	b = binary.LittleEndian.AppendUint32(b, 28)
+	b = binary.LittleEndian.AppendUint32(b, 0x1A2B3C4D)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, ^uint64(0)) // 段长度未知
+	b = binary.LittleEndian.AppendUint32(b, 28)
+
+	b = binary.LittleEndian.AppendUint32(b, pcapngIDB)
+	b = binary.LittleEndian.AppendUint32(b, 20)
+	b = binary.LittleEndian.AppendUint16(b, linkTypeRaw)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0) // 不截断
+	b = binary.LittleEndian.AppendUint32(b, 20)
+	return w.Write(b)
+}
+
+// appendPcapngPacket 把一个报文封装成Enhanced Packet Block,时间戳单位为微秒
+func appendPcapngPacket(b []byte, ts time.Time, pkt []byte) []byte {
+	pad := (4 - len(pkt)%4) % 4
+	total := uint32(32 + len(pkt) + pad)
+	us := uint64(ts.UnixMicro())
+	b = binary.LittleEndian.AppendUint32(b, pcapngEPB)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = binary.LittleEndian.AppendUint32(b, 0) // 接口ID
+	b = binary.LittleEndian.AppendUint32(b, uint32(us>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(us))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt)))
+	b = append(b, pkt...)
+	b = append(b, make([]byte, pad)...)
+	return binary.LittleEndian.AppendUint32(b, total)
+}
+
+// TCP标志位
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// buildPacket 合成一个IP报文,proto为6(TCP)或17(UDP);src和dst要是同一协议族
+func buildPacket(src, dst netip.AddrPort, proto byte, seq, ack uint32, flags byte, payload []byte) []byte {
+	var l4 []byte
+	if proto == 6 {
+		l4 = make([]byte, 20, 20+len(payload))
+		binary.BigEndian.PutUint16(l4[0:], src.Port())
+		binary.BigEndian.PutUint16(l4[2:], dst.Port())
+		binary.BigEndian.PutUint32(l4[4:], seq)
+		binary.BigEndian.PutUint32(l4[8:], ack)
+		l4[12] = 5 << 4
+		l4[13] = flags
+		binary.BigEndian.PutUint16(l4[14:], 65535)
+	} else {
+		l4 = make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint16(l4[0:], src.Port())
+		binary.BigEndian.PutUint16(l4[2:], dst.Port())
+		binary.BigEndian.PutUint16(l4[4:], uint16(8+len(payload)))
+	}
+	l4 = append(l4, payload...)
+
+	var ip []byte
+	s, d := src.Addr().AsSlice(), dst.Addr().AsSlice()
+	if src.Addr().Is4() {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(l4)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // DF
+		ip[8] = 64
+		ip[9] = proto
+		copy(ip[12:], s)
+		copy(ip[16:], d)
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(l4)))
+		ip[6] = proto
+		ip[7] = 64
+		copy(ip[8:], s)
+		copy(ip[24:], d)
+	}
+
+	// 伪首部校验和
+	sum := checksumAdd(0, s)
+	sum = checksumAdd(sum, d)
+	sum += uint32(proto) + uint32(len(l4))
+	csum := checksum(sum, l4)
+	if proto == 6 {
+		binary.BigEndian.PutUint16(l4[16:], csum)
+	} else {
+		if csum == 0 {
+			csum = 0xffff
+		}
+		binary.BigEndian.PutUint16(l4[6:], csum)
+	}
+	return append(ip, l4...)
+}
+
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func checksum(sum uint32, b []byte) uint16 {
+	sum = checksumAdd(sum, b)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// pcapngBlocks 按块拆分文件内容,检查每个块首尾的长度一致且4字节对齐
+func pcapngBlocks(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+	var blocks [][]byte
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("trailing %d bytes", len(b))
+		}
+		n := binary.LittleEndian.Uint32(b[4:])
+		if n%4 != 0 || int(n) > len(b) {
+			t.Fatalf("bad block length %d", n)
+		}
+		if tail := binary.LittleEndian.Uint32(b[n-4:]); tail != n {
+			t.Fatalf("block length %d, trailing length %d", n, tail)
+		}
+		blocks = append(blocks, b[:n])
+		b = b[n:]
+	}
+	return blocks
+}
+
+func TestPcapngLayout(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := writePcapngHeader(&buf)
+	if err != nil || n != buf.Len() {
+		t.Fatalf("header wrote %d of %d bytes: %v", n, buf.Len(), err)
+	}
+	ts := time.UnixMicro(1700000000123456)
+	for _, size := range []int{0, 1, 3, 4, 5} {
+		buf.Write(appendPcapngPacket(nil, ts, bytes.Repeat([]byte{0xab}, size)))
+	}
+	blocks := pcapngBlocks(t, buf.Bytes())
+	if len(blocks) != 7 {
+		t.Fatalf("%d blocks, want 7", len(blocks))
+	}
+	shb, idb := blocks[0], blocks[1]
+	if binary.LittleEndian.Uint32(shb) != pcapngSHB || binary.LittleEndian.Uint32(shb[8:]) != 0x1A2B3C4D {
+		t.Fatalf("bad section header % x", shb)
+	}
+	if binary.LittleEndian.Uint32(idb) != pcapngIDB || binary.LittleEndian.Uint16(idb[8:]) != linkTypeRaw {
+		t.Fatalf("bad interface block % x", idb)
+	}
+	for i, size := range []int{0, 1, 3, 4, 5} {
+		epb := blocks[2+i]
+		if binary.LittleEndian.Uint32(epb) != pcapngEPB {
+			t.Fatalf("block %d type %#x", i, binary.LittleEndian.Uint32(epb))
+		}
+		us := uint64(binary.LittleEndian.Uint32(epb[12:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[16:]))
+		if us != uint64(ts.UnixMicro()) {
+			t.Errorf("block %d timestamp %d, want %d", i, us, ts.UnixMicro())
+		}
+		captured, orig := binary.LittleEndian.Uint32(epb[20:]), binary.LittleEndian.Uint32(epb[24:])
+		if int(captured) != size || int(orig) != size {
+			t.Errorf("block %d lengths %d/%d, want %d", i, captured, orig, size)
+		}
+		if len(epb) != 32+(size+3)/4*4 {
+			t.Errorf("block %d is %d bytes, want padding to 4", i, len(epb))
+		}
+	}
+}
+
+func TestBuildPacket(t *testing.T) {
+	v4a, v4b := netip.MustParseAddrPort("192.0.2.1:51000"), netip.MustParseAddrPort("198.51.100.2:443")
+	v6a, v6b := netip.MustParseAddrPort("[2001:db8::1]:51000"), netip.MustParseAddrPort("[2001:db8::2]:443")
+	for _, tc := range []struct {
+		name     string
+		src, dst netip.AddrPort
+		proto    byte
+		ipLen    int
+		l4Len    int
+	}{
+		{"tcp4", v4a, v4b, 6, 20, 20},
+		{"udp4", v4a, v4b, 17, 20, 8},
+		{"tcp6", v6a, v6b, 6, 40, 20},
+		{"udp6", v6a, v6b, 17, 40, 8},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := []byte("hello")
+			pkt := buildPacket(tc.src, tc.dst, tc.proto, 1, 2, tcpPSH|tcpACK, payload)
+			if len(pkt) != tc.ipLen+tc.l4Len+len(payload) {
+				t.Fatalf("packet is %d bytes", len(pkt))
+			}
+			ip, l4 := pkt[:tc.ipLen], pkt[tc.ipLen:]
+			if tc.ipLen == 20 {
+				if ip[0] != 0x45 || ip[9] != tc.proto || int(binary.BigEndian.Uint16(ip[2:])) != len(pkt) {
+					t.Fatalf("bad IPv4 header % x", ip)
+				}
+				if checksum(0, ip) != 0 {
+					t.Error("IPv4 header checksum does not verify")
+				}
+			} else if ip[0]>>4 != 6 || ip[6] != tc.proto || int(binary.BigEndian.Uint16(ip[4:])) != len(l4) {
+				t.Fatalf("bad IPv6 header % x", ip)
+			}
+			if binary.BigEndian.Uint16(l4) != tc.src.Port() || binary.BigEndian.Uint16(l4[2:]) != tc.dst.Port() {
+				t.Errorf("ports %d -> %d", binary.BigEndian.Uint16(l4), binary.BigEndian.Uint16(l4[2:]))
+			}
+			// 带上伪首部重新计算,结果为0说明校验和正确
+			s, d := tc.src.Addr().AsSlice(), tc.dst.Addr().AsSlice()
+			sum := checksumAdd(checksumAdd(0, s), d) + uint32(tc.proto) + uint32(len(l4))
+			if checksum(sum, l4) != 0 {
+				t.Error("transport checksum does not verify")
+			}
+			if !bytes.Equal(l4[tc.l4Len:], payload) {
+				t.Errorf("payload % x", l4[tc.l4Len:])
+			}
+		})
+	}
+}
@@ -1,182 +1,215 @@
 package proxy
 
 import (
-	"fmt"
+	"errors"
 	"log"
 	"net"
 	"strings"
-	"sync"
 	"time"
-
-	"github.com/dosgo/wslPortForward/config"
 )
 
 const (
-	TCP_TIMEOUT = 5 * time.Minute // TCP连接空闲超时
-	UDP_TIMEOUT = 2 * time.Minute // UDP会话空闲超时
+	TCP_TIMEOUT  = 5 * time.Minute // TCP连接空闲超时
+	UDP_TIMEOUT  = 2 * time.Minute // UDP会话空闲超时
+	DIAL_TIMEOUT = 5 * time.Second // 连接目标超时
+	// 对端一直不读数据时写入的超时,避免缓冲区满的连接一直占着
+	WRITE_TIMEOUT = 10 * time.Second
 )
 
-var udpNat sync.Map
-
-func StartPoxy(conf *config.Conf, reboot bool) {
-	if reboot {
-		for _, v := range conf.Configs {
-			if v.Listener != nil {
-				v.Listener.Close()
-			}
-		}
+// pickTimeout 规则设置优先,其次全局设置,都为0时用默认值;单位秒,负数表示不超时
+func pickTimeout(ruleSec, globalSec int, def time.Duration) time.Duration {
+	sec := ruleSec
+	if sec == 0 {
+		sec = globalSec
 	}
-	var wslIP = ""
-	if conf.AutoUseWslIp {
-		wslIP = config.GetWslIP()
+	if sec == 0 {
+		return def
 	}
-	var err error
-	for _, v := range conf.Configs {
-		var targetAddr = v.TargetAddr
-		if conf.AutoUseWslIp {
-			targetAddrs := strings.Split(v.TargetAddr, ":")
-			if targetAddrs[0] == "127.0.0.1" && wslIP != "" {
-				targetAddr = wslIP + ":" + targetAddrs[1]
-			}
-		}
-
-		if v.Protocol == "tcp" {
-			v.Listener, err = StartTCPServer(fmt.Sprintf("0.0.0.0:%d", v.ListenPort), targetAddr)
-			if err == nil {
-				v.Status = true
-			}
-		}
-		if v.Protocol == "udp" {
-			v.UdpConn, err = StartUDPServer(fmt.Sprintf("0.0.0.0:%d", v.ListenPort), targetAddr)
-			if err == nil {
-				v.Status = true
-			}
-		}
+	if sec < 0 {
+		return 0
 	}
+	return time.Duration(sec) * time.Second
 }
 
-func StartTCPServer(listenAddr, targetAddr string) (net.Listener, error) {
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		log.Printf("TCP proxy %s -> %s err:%v\r\n", err)
-		return nil, err
+// globals 当前的全局设置,每次读取,修改全局设置后不用重启规则;
+// http协议的空闲超时例外,在启动时交给http.Server
+func (r *rule) globals() *globalSettings {
+	if g := r.global.Load(); g != nil {
+		return g
 	}
-	log.Printf("TCP proxy %s -> %s ok\r\n", listenAddr, targetAddr)
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("TCP Accept err: %v\r\n", err)
-				break
-			}
+	return &globalSettings{}
+}
 
-			go handleTCPConnection(conn, targetAddr)
-		}
-	}()
-	return listener, nil
+func (r *rule) tcpTimeout() time.Duration {
+	return pickTimeout(r.cfg.TCPTimeout, r.globals().tcpTimeout, TCP_TIMEOUT)
 }
 
-func handleTCPConnection(src net.Conn, targetAddr string) {
-	defer src.Close()
+func (r *rule) udpTimeout() time.Duration {
+	return pickTimeout(r.cfg.UDPTimeout, r.globals().udpTimeout, UDP_TIMEOUT)
+}
 
-	// 带超时的目标连接
-	dst, err := net.DialTimeout("tcp", targetAddr, 5*time.Second)
-	if err != nil {
-		log.Printf("TCP connect err: %v\r\n", err)
-		return
-	}
-	defer dst.Close()
+func (r *rule) dialTimeout() time.Duration {
+	return pickTimeout(r.cfg.DialTimeout, r.globals().dialTimeout, DIAL_TIMEOUT)
+}
 
-	// 双向带超时的数据转发
-	go pipeWithTimeout(src, dst, TCP_TIMEOUT)
-	pipeWithTimeout(dst, src, TCP_TIMEOUT)
+func (r *rule) writeTimeout() time.Duration {
+	return pickTimeout(r.cfg.WriteTimeout, r.globals().writeTimeout, WRITE_TIMEOUT)
 }
 
-// --------------------- UDP 代理实现 ---------------------
-func StartUDPServer(listenAddr, targetAddr string) (*net.UDPConn, error) {
-	srcAddr, _ := net.ResolveUDPAddr("udp", listenAddr)
-	listener, err := net.ListenUDP("udp", srcAddr)
+func (r *rule) startTCP(listenAddr string, rt *router) error {
+	listener, err := net.Listen("tcp"+r.family, listenAddr)
 	if err != nil {
-		log.Printf("UDP proxy %s -> %s err:%v\r\n", err)
-		return nil, err
+		log.Printf("%s proxy %s -> %s err:%v\r\n", strings.ToUpper(r.cfg.Protocol), listenAddr, rt.def, err)
+		return err
 	}
-
-	log.Printf("UDP proxy  %s -> %s ok\r\n", listenAddr, targetAddr)
-
-	buf := make([]byte, 65507) // UDP 最大报文长度
+	log.Printf("%s proxy %s -> %s ok\r\n", strings.ToUpper(r.cfg.Protocol), listenAddr, rt.def)
+	r.listeners = append(r.listeners, listener)
 	go func() {
+		var backoff time.Duration
 		for {
-			// 读取客户端数据
-			n, clientAddr, err := listener.ReadFromUDP(buf)
+			conn, err := listener.Accept()
 			if err != nil {
-				log.Printf("UDP read err: %v\r\n", err)
-				break
+				if errors.Is(err, net.ErrClosed) {
+					break
+				}
+				// 文件描述符耗尽等错误不退出,等一会再接受,否则规则会悄悄停止工作
+				backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+				log.Printf("TCP Accept err: %v; retrying in %v\r\n", err, backoff)
+				select {
+				case <-time.After(backoff):
+					continue
+				case <-r.done:
+					return
+				}
 			}
-
-			localConn, ok := udpNat.Load(clientAddr.String())
-			if ok {
-				localConn.(net.Conn).Write(buf[:n])
-			} else {
-				go handleUDPPacket(listener, clientAddr, buf[:n], targetAddr)
+			backoff = 0
+			if !r.clientAllowed(conn.RemoteAddr()) {
+				log.Printf("%s proxy %s denied client %s\r\n", strings.ToUpper(r.cfg.Protocol), listenAddr, conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			if l := r.limiter; l != nil {
+				// 开启AcceptProxy时对端是前置代理,读到PROXY头后再按真实客户端检查单IP并发数
+				peer := conn.RemoteAddr()
+				if r.cfg.AcceptProxy {
+					peer = nil
+				}
+				if !r.admit(l, peer) {
+					log.Printf("%s proxy %s rejected client %s: connection limit\r\n", strings.ToUpper(r.cfg.Protocol), listenAddr, conn.RemoteAddr())
+					conn.Close()
+					continue
+				}
+				go func() {
+					defer l.release(peer)
+					r.handleTCPConnection(conn, rt)
+				}()
+				continue
 			}
+
+			go r.handleTCPConnection(conn, rt)
 		}
 	}()
-	return listener, nil
+	return nil
 }
 
-func handleUDPPacket(conn *net.UDPConn, clientAddr *net.UDPAddr, data []byte, targetAddr string) {
-	// 创建或复用目标连接
-	targetConn, err := net.Dial("udp", targetAddr)
-	if err != nil {
-		log.Printf("UDP connect err: %v\r\n", err)
-		return
+func (r *rule) handleTCPConnection(src net.Conn, rt *router) {
+	defer src.Close()
+	// 开启接收PROXY头时,用头里的客户端地址做日志、统计和负载均衡
+	client, local := src.RemoteAddr(), src.LocalAddr()
+	var rest []byte
+	if r.cfg.AcceptProxy {
+		var err error
+		if client, local, rest, err = readProxyHeader(src); err != nil {
+			log.Printf("TCP read proxy header from %s err: %v\r\n", src.RemoteAddr(), err)
+			return
+		}
+		// Accept时检查的是前置代理的地址,这里再检查真实客户端
+		if !r.clientAllowed(client) {
+			log.Printf("%s proxy %s denied client %s via %s\r\n", strings.ToUpper(r.cfg.Protocol), local, client, src.RemoteAddr())
+			return
+		}
+		if l := r.limiter; l != nil {
+			ip := addrKey(client)
+			if !r.admitIP(l, ip) {
+				log.Printf("%s proxy %s rejected client %s via %s: connection limit\r\n", strings.ToUpper(r.cfg.Protocol), local, client, src.RemoteAddr())
+				return
+			}
+			defer l.releaseIP(ip)
+		}
 	}
-	defer targetConn.Close()
-	udpNat.Store(clientAddr.String(), targetConn)
-	defer udpNat.Delete(clientAddr.String())
-	// 转发到目标
-	if _, err := targetConn.Write(data); err != nil {
-		log.Printf("UDP Forward err : %v\r\n", err)
-		return
+	// tls协议先完成握手,之后转发解密后的数据
+	if r.tlsConf != nil {
+		raw := src
+		if len(rest) > 0 {
+			raw, rest = &prefixConn{Conn: src, buf: rest}, nil
+		}
+		tc, err := tlsServer(raw, r.tlsConf)
+		if err != nil {
+			log.Printf("TLS handshake with %s err: %v\r\n", client, err)
+			return
+		}
+		defer tc.Close()
+		src = tc
 	}
-
-	for {
-		// 等待响应并回传
-		resp := make([]byte, 65507)
-		targetConn.SetReadDeadline(time.Now().Add(UDP_TIMEOUT))
-		n, err := targetConn.Read(resp)
+	// sni协议按ClientHello中的主机名选择目标,读到的数据原样发给目标
+	lb := rt.def
+	if r.cfg.Protocol == "sni" {
+		host, hello, err := peekSNI(src, rest)
 		if err != nil {
-			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
-				log.Printf("UDP read err: %v\r\n", err)
-			}
+			log.Printf("SNI read client hello from %s err: %v\r\n", client, err)
 			return
 		}
+		lb, rest = rt.balancer(host, ""), hello
+	}
+	t := r.open(client, "", src)
+	if t == nil {
+		return
+	}
+	defer r.close(t)
 
-		if _, err := conn.WriteToUDP(resp[:n], clientAddr); err != nil {
-			log.Printf("UDP write err: %v\r\n", err)
+	// http协议交给反向代理,每个请求按Host头选择目标
+	if r.httpLn != nil {
+		if len(rest) > 0 {
+			src = &prefixConn{Conn: src, buf: rest}
 		}
+		r.serveHTTP(src, client, local, rt, t)
+		return
 	}
-}
 
-// --------------------- 通用工具函数 ---------------------
-func pipeWithTimeout(dst, src net.Conn, timeout time.Duration) {
-	buf := make([]byte, 32*1024) // 32KB 缓冲区
-	for {
-		// 设置读取超时
-		src.SetReadDeadline(time.Now().Add(timeout))
-		n, err := src.Read(buf)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				log.Printf("read time out : %s\r\n", src.RemoteAddr())
-			}
-			break
+	// socks5和http-connect协议由客户端指定目标
+	if r.cfg.Dynamic() {
+		if len(rest) > 0 {
+			src = &prefixConn{Conn: src, buf: rest}
 		}
+		if r.cfg.Protocol == "socks5" {
+			r.serveSOCKS5(src, client, t)
+		} else {
+			r.serveConnect(src, client, t)
+		}
+		return
+	}
 
-		// 设置写入超时
-		dst.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		if _, err := dst.Write(buf[:n]); err != nil {
-			log.Printf("write err: %v\r\n", err)
-			break
+	// 带超时的目标连接,失败时换下一个目标
+	dst, b, err := r.dial("tcp", lb, client, r.proxyHeader("tcp", client, local))
+	if err != nil {
+		t.setTarget(lb.String())
+		t.setReason(closeDial)
+		return
+	}
+	defer b.done()
+	defer dst.Close()
+	if !r.attach(t, dst, b.addr) {
+		return
+	}
+	// 读PROXY头时多读到的数据
+	if len(rest) > 0 {
+		if _, err := dst.Write(rest); err != nil {
+			return
 		}
+		t.tapIn(rest)
+		t.addIn(int64(len(rest)))
 	}
+
+	// 双向带超时的数据转发
+	relay(src, dst, r.tcpTimeout(), r.writeTimeout(), t, r.shapeChunk())
 }
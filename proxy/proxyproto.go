@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// 等待客户端发送PROXY头的时间
+const proxyHeaderTimeout = 5 * time.Second
+
+// PROXY protocol v2 的固定签名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errBadProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyHeaderV1 生成文本格式的PROXY protocol v1头,只支持TCP
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcIP, srcPort := addrIPPort(src)
+	dstIP, dstPort := addrIPPort(dst)
+	if srcIP == nil || dstIP == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else {
+		// 两端协议族不同时都用IPv6表示
+		family = "TCP6"
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort)
+}
+
+// proxyHeaderV2 生成二进制格式的PROXY protocol v2头,network为"tcp"或"udp"
+func proxyHeaderV2(network string, src, dst net.Addr) []byte {
+	srcIP, srcPort := addrIPPort(src)
+	dstIP, dstPort := addrIPPort(dst)
+	hdr := make([]byte, 16, 16+36)
+	copy(hdr, proxyV2Sig)
+	hdr[12] = 0x21 // 版本2,PROXY命令
+	if srcIP == nil || dstIP == nil {
+		hdr[13] = 0x00 // UNSPEC
+		return hdr
+	}
+	var addrs []byte
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		hdr[13] = 0x10 // AF_INET
+		addrs = append(append(addrs, srcIP.To4()...), dstIP.To4()...)
+	} else {
+		hdr[13] = 0x20 // AF_INET6
+		addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+	}
+	if network == "udp" {
+		hdr[13] |= 0x02 // DGRAM
+	} else {
+		hdr[13] |= 0x01 // STREAM
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcPort))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstPort))
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// proxyHeader 按规则设置生成发给目标的PROXY头,没有开启时返回nil。
+// v1不支持UDP,UDP规则总是使用v2
+func (r *rule) proxyHeader(network string, client, local net.Addr) []byte {
+	switch r.cfg.SendProxy {
+	case config.ProxyV1:
+		if network == "tcp" {
+			return proxyHeaderV1(client, local)
+		}
+		return proxyHeaderV2(network, client, local)
+	case config.ProxyV2:
+		return proxyHeaderV2(network, client, local)
+	}
+	return nil
+}
+
+// readProxyHeader 读取客户端发来的PROXY v1/v2头,返回其中的源地址和目标地址。
+// 头里没有地址(UNKNOWN/LOCAL)时返回连接本身的地址;rest是多读到的数据,要先发给目标
+func readProxyHeader(c net.Conn) (src, dst net.Addr, rest []byte, err error) {
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	src, dst = c.RemoteAddr(), c.LocalAddr()
+	br := bufio.NewReaderSize(c, 256)
+	sig, err := br.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var s, d net.Addr
+	if bytes.Equal(sig, proxyV2Sig) {
+		s, d, err = parseProxyV2(br)
+	} else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		s, d, err = parseProxyV1(br)
+	} else {
+		err = errBadProxyHeader
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if s != nil {
+		src, dst = s, d
+	}
+	if n := br.Buffered(); n > 0 {
+		rest, _ = br.Peek(n)
+	}
+	return src, dst, rest, nil
+}
+
+func parseProxyV1(br *bufio.Reader) (src, dst net.Addr, err error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errBadProxyHeader
+	}
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, nil, errBadProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(f[2]), net.ParseIP(f[3])
+	srcPort, err1 := strconv.ParseUint(f[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(f[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, errBadProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func parseProxyV2(br *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, errBadProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]&0x0f == 0 {
+		return nil, nil, nil // LOCAL命令,用连接本身的地址
+	}
+	var ipLen int
+	switch hdr[13] >> 4 {
+	case 1:
+		ipLen = 4
+	case 2:
+		ipLen = 16
+	default:
+		return nil, nil, nil // UNSPEC或unix地址
+	}
+	if len(body) < ipLen*2+4 {
+		return nil, nil, errBadProxyHeader
+	}
+	srcIP := net.IP(body[:ipLen])
+	dstIP := net.IP(body[ipLen : ipLen*2])
+	srcPort := int(binary.BigEndian.Uint16(body[ipLen*2:]))
+	dstPort := int(binary.BigEndian.Uint16(body[ipLen*2+2:]))
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51000}
+	v4dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 443}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51000}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	local := append([]byte(nil), proxyHeaderV2("tcp", nil, nil)...)
+	local[12] = 0x20
+	short := proxyHeaderV2("tcp", v4src, v4dst)[:16]
+	short[15] = 4 // 长度不够放两个IPv4地址和端口
+	for _, tc := range []struct {
+		name     string
+		in       []byte
+		src, dst string // 为空时应是连接本身的地址
+		rest     string
+		wantErr  bool
+	}{
+		{name: "v1 tcp4", in: proxyHeaderV1(v4src, v4dst), src: "192.0.2.1:51000", dst: "198.51.100.2:443"},
+		{name: "v1 tcp6", in: proxyHeaderV1(v6src, v6dst), src: "[2001:db8::1]:51000", dst: "[2001:db8::2]:443"},
+		{name: "v1 rest", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\r\nGET / HTTP/1.1\r\n"),
+			src: "192.0.2.1:51000", dst: "198.51.100.2:443", rest: "GET / HTTP/1.1\r\n"},
+		{name: "v1 unknown", in: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 bad port", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 99999 443\r\n"), wantErr: true},
+		{name: "v1 bad family", in: []byte("PROXY UDP4 192.0.2.1 198.51.100.2 51000 443\r\n"), wantErr: true},
+		{name: "v1 no crlf", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\n"), wantErr: true},
+		{name: "v1 too long", in: []byte("PROXY TCP6 " + strings.Repeat("f", 120) + "\r\n"), wantErr: true},
+		{name: "v2 tcp4", in: proxyHeaderV2("tcp", v4src, v4dst), src: "192.0.2.1:51000", dst: "198.51.100.2:443"},
+		{name: "v2 tcp6 rest", in: append(proxyHeaderV2("tcp", v6src, v6dst), "hello"...),
+			src: "[2001:db8::1]:51000", dst: "[2001:db8::2]:443", rest: "hello"},
+		{name: "v2 local", in: local},
+		{name: "v2 short", in: append(short, 1, 2, 3, 4), wantErr: true},
+		{name: "no header", in: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go client.Write(tc.in)
+			src, dst, rest, err := readProxyHeader(server)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("got %v -> %v, want error", src, dst)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantSrc, wantDst := tc.src, tc.dst
+			if wantSrc == "" {
+				wantSrc, wantDst = server.RemoteAddr().String(), server.LocalAddr().String()
+			}
+			if src.String() != wantSrc || dst.String() != wantDst {
+				t.Errorf("got %v -> %v, want %s -> %s", src, dst, wantSrc, wantDst)
+			}
+			if !bytes.Equal(rest, []byte(tc.rest)) {
+				t.Errorf("rest = %q, want %q", rest, tc.rest)
+			}
+		})
+	}
+}
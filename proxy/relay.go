@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	relayChunk = 128 * 1024             // splice 每次最多转发的字节数,决定统计刷新的粒度
+	probeGrace = 100 * time.Millisecond // 打断读取后等待各方向报告进度的时间
+)
+
+var relayBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32*1024) // 32KB 缓冲区
+		return &buf
+	},
+}
+
+// relay 双向转发;一个方向读到EOF时只关闭对端的写方向(半关闭),
+// 另一个方向继续转发直到也结束;任一方向出错则关闭两端。
+// chunk大于0时每次最多读取chunk字节,用于限速;限速在每次转发后等待。
+// 开始时规则在抓包则不使用splice,转发的数据都交给旁路。
+// 对端超过writeTimeout不读数据时关闭连接,0为不限制
+func relay(client, target net.Conn, timeout, writeTimeout time.Duration, t *tracked, chunk int) {
+	idle := newIdleWatch(timeout, client, target)
+	defer idle.stop()
+	splice := chunk <= 0 && !t.tapping()
+	errc := make(chan error, 2)
+	go func() {
+		errc <- halfPipe(target, client, idle, writeTimeout, chunk, splice, func(n int64) {
+			t.addIn(n)
+			t.waitIn(n)
+		}, t.tapIn)
+	}()
+	go func() {
+		errc <- halfPipe(client, target, idle, writeTimeout, chunk, splice, func(n int64) {
+			t.addOut(n)
+			t.waitOut(n)
+		}, t.tapOut)
+	}()
+	var first error
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			if first == nil {
+				first = err
+			}
+			client.Close()
+			target.Close()
+		}
+	}
+	t.setReason(relayReason(idle, first))
+}
+
+// halfPipe 单向转发,src正常结束后关闭dst的写方向
+func halfPipe(dst, src net.Conn, idle *idleWatch, writeTimeout time.Duration, chunk int, splice bool, count func(int64), tap func([]byte)) error {
+	err := pipe(dst, src, idle, writeTimeout, chunk, splice, count, tap)
+	if err == nil {
+		err = closeWrite(dst)
+	}
+	return err
+}
+
+// closeWrite 关闭写方向;包装过的连接通过NetConn找到底层连接,都不支持时整个关闭
+func closeWrite(c net.Conn) error {
+	for {
+		if cw, ok := c.(interface{ CloseWrite() error }); ok {
+			return cw.CloseWrite()
+		}
+		nc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return c.Close()
+		}
+		c = nc.NetConn()
+	}
+}
+
+// pipe 从src转发到dst,读到EOF时返回nil。
+// 两端都是TCP、在Linux上且允许时走splice零拷贝,否则用池化缓冲区拷贝,读到的数据交给tap
+func pipe(dst, src net.Conn, idle *idleWatch, writeTimeout time.Duration, chunk int, splice bool, count func(int64), tap func([]byte)) error {
+	bufp := relayBufPool.Get().(*[]byte)
+	defer relayBufPool.Put(bufp)
+	w := &stallWriter{c: dst, timeout: writeTimeout}
+	if splice && canSplice(dst, src) {
+		return splicePipe(w, src, idle, count, *bufp)
+	}
+	buf := *bufp
+	if chunk > 0 && chunk < len(buf) {
+		buf = buf[:chunk]
+	}
+	r := &countReader{r: src, idle: idle, count: count, tap: tap}
+	for {
+		_, err := io.CopyBuffer(w, r, buf)
+		if idle.interrupted(src, err) {
+			continue
+		}
+		return err
+	}
+}
+
+// splicePipe 按relayChunk分段调用ReadFrom,让内核splice数据,每段结束后更新统计
+func splicePipe(w *stallWriter, src net.Conn, idle *idleWatch, count func(int64), buf []byte) error {
+	lr := &io.LimitedReader{R: src}
+	for {
+		lr.N = relayChunk
+		w.refresh()
+		n, err := io.CopyBuffer(w.c, lr, buf)
+		if n > 0 {
+			count(n)
+			idle.touch()
+		}
+		if w.stalled(err) {
+			return errWriteStall
+		}
+		if idle.interrupted(src, err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if lr.N > 0 {
+			return nil // EOF
+		}
+	}
+}
+
+func canSplice(dst, src net.Conn) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	_, ok1 := dst.(*net.TCPConn)
+	_, ok2 := src.(*net.TCPConn)
+	return ok1 && ok2
+}
+
+var errWriteStall = errors.New("write timeout")
+
+// stallWriter 写入前设置写deadline,对端超过timeout不读数据时返回errWriteStall。
+// 不实现ReadFrom,让io.CopyBuffer使用我们的缓冲区;deadline只在过去timeout/10后才刷新,timeout为0时不设置
+type stallWriter struct {
+	c        net.Conn
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func (w *stallWriter) refresh() {
+	now := time.Now()
+	if w.timeout <= 0 || w.deadline.Sub(now) > w.timeout-w.timeout/10 {
+		return
+	}
+	w.deadline = now.Add(w.timeout)
+	w.c.SetWriteDeadline(w.deadline)
+}
+
+// stalled 判断err是否是写deadline到期,读deadline(空闲探测)到期时返回false
+func (w *stallWriter) stalled(err error) bool {
+	if err == nil || w.timeout <= 0 || !errors.Is(err, os.ErrDeadlineExceeded) || time.Now().Before(w.deadline) {
+		return false
+	}
+	log.Printf("write time out : %s\r\n", w.c.RemoteAddr())
+	return true
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	w.refresh()
+	n, err := w.c.Write(p)
+	if w.stalled(err) {
+		err = errWriteStall
+	}
+	return n, err
+}
+
+// countReader 每次读取后更新统计和空闲计时
+type countReader struct {
+	r     io.Reader
+	idle  *idleWatch
+	count func(int64)
+	tap   func([]byte)
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.tap(p[:n])
+		c.count(int64(n))
+		c.idle.touch()
+	}
+	return n, err
+}
+
+// idleWatch 整条连接共用一个空闲计时器,代替每次读写都设置deadline。
+// 计时器到期时如果一直没有活动,先把读deadline设为当前时间打断正在进行的
+// splice,让它报告已转发的字节;等待probeGrace后仍无活动才关闭连接
+type idleWatch struct {
+	timeout time.Duration
+	conns   [2]net.Conn
+	last    atomic.Int64 // 最后一次活动的时间
+	probing atomic.Bool
+	expired atomic.Bool
+	timer   *time.Timer
+}
+
+func newIdleWatch(timeout time.Duration, a, b net.Conn) *idleWatch {
+	w := &idleWatch{timeout: timeout, conns: [2]net.Conn{a, b}}
+	w.touch()
+	if timeout > 0 {
+		w.timer = time.AfterFunc(timeout, w.check)
+	}
+	return w
+}
+
+func (w *idleWatch) touch() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+func (w *idleWatch) check() {
+	idle := time.Since(time.Unix(0, w.last.Load()))
+	if idle < w.timeout {
+		w.probing.Store(false)
+		w.timer.Reset(w.timeout - idle)
+		return
+	}
+	if !w.probing.Swap(true) {
+		now := time.Now()
+		for _, c := range w.conns {
+			c.SetReadDeadline(now)
+		}
+		w.timer.Reset(probeGrace)
+		return
+	}
+	log.Printf("read time out : %s\r\n", w.conns[0].RemoteAddr())
+	w.expired.Store(true)
+	for _, c := range w.conns {
+		c.Close()
+	}
+}
+
+// interrupted 判断err是否是空闲探测打断的读取,是则清除deadline继续转发
+func (w *idleWatch) interrupted(src net.Conn, err error) bool {
+	if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) || w.expired.Load() {
+		return false
+	}
+	src.SetReadDeadline(time.Time{})
+	return true
+}
+
+func (w *idleWatch) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// legacyPipe 重设计之前的转发实现:32KB缓冲区,每次读写都设置deadline,只用于基准对比
+func legacyPipe(dst, src net.Conn, timeout time.Duration) {
+	buf := make([]byte, 32*1024)
+	for {
+		src.SetReadDeadline(time.Now().Add(timeout))
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		dst.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// plainConn 隐藏*net.TCPConn类型,强制走缓冲区拷贝
+type plainConn struct {
+	net.Conn
+}
+
+func (c plainConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// benchmarkRelay 客户端 -> run转发 -> 丢弃数据的目标端,统计单向吞吐
+func benchmarkRelay(b *testing.B, run func(client, target net.Conn)) {
+	sinkLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sinkLn.Close()
+	done := make(chan struct{})
+	go func() {
+		c, err := sinkLn.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, c)
+		c.Close()
+		close(done)
+	}()
+
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer proxyLn.Close()
+	go func() {
+		client, err := proxyLn.Accept()
+		if err != nil {
+			return
+		}
+		target, err := net.Dial("tcp", sinkLn.Addr().String())
+		if err != nil {
+			client.Close()
+			return
+		}
+		run(client, target)
+		client.Close()
+		target.Close()
+	}()
+
+	conn, err := net.Dial("tcp", proxyLn.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	payload := make([]byte, 64*1024)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+func BenchmarkRelayLegacy(b *testing.B) {
+	benchmarkRelay(b, func(client, target net.Conn) {
+		legacyPipe(target, client, TCP_TIMEOUT)
+	})
+}
+
+func BenchmarkRelay(b *testing.B) {
+	benchmarkRelay(b, func(client, target net.Conn) {
+		relay(client, target, TCP_TIMEOUT, WRITE_TIMEOUT, &tracked{stats: &ruleStats{}}, 0)
+	})
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkRelay(b, func(client, target net.Conn) {
+		relay(plainConn{client}, plainConn{target}, TCP_TIMEOUT, WRITE_TIMEOUT, &tracked{stats: &ruleStats{}}, 0)
+	})
+}
+
+// tcpPair 返回一对互相连接的TCP连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// startRelay 客户端 <-> relay <-> 目标,返回客户端和目标一侧的连接以及relay结束的通知
+func startRelay(t *testing.T, timeout time.Duration, wrap bool) (client, target net.Conn, tr *tracked, done chan struct{}) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, target := tcpPair(t)
+	tr = &tracked{stats: &ruleStats{}}
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		if wrap {
+			relay(plainConn{proxyIn}, plainConn{proxyOut}, timeout, WRITE_TIMEOUT, tr, 0)
+		} else {
+			relay(proxyIn, proxyOut, timeout, WRITE_TIMEOUT, tr, 0)
+		}
+	}()
+	return client, target, tr, done
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		wrap bool
+	}{{"splice", false}, {"buffered", true}} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, target, tr, done := startRelay(t, TCP_TIMEOUT, tc.wrap)
+			if _, err := client.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			client.(*net.TCPConn).CloseWrite()
+			// 目标读到客户端的数据后收到EOF,之后仍然可以回复
+			got, err := io.ReadAll(target)
+			if err != nil || string(got) != "ping" {
+				t.Fatalf("target read %q, %v", got, err)
+			}
+			if _, err := target.Write([]byte("pong")); err != nil {
+				t.Fatal(err)
+			}
+			target.(*net.TCPConn).CloseWrite()
+			got, err = io.ReadAll(client)
+			if err != nil || string(got) != "pong" {
+				t.Fatalf("client read %q, %v", got, err)
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("relay did not finish after both sides closed")
+			}
+			if in, out := tr.bytesIn.Load(), tr.bytesOut.Load(); in != 4 || out != 4 {
+				t.Fatalf("bytes in/out = %d/%d, want 4/4", in, out)
+			}
+			if r := tr.reason.Load(); r == nil || *r != closeEOF {
+				t.Fatalf("close reason = %v, want %q", r, closeEOF)
+			}
+		})
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		wrap bool
+	}{{"splice", false}, {"buffered", true}} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, _, tr, done := startRelay(t, 200*time.Millisecond, tc.wrap)
+			// 有数据往来时不超时
+			for i := 0; i < 3; i++ {
+				time.Sleep(100 * time.Millisecond)
+				if _, err := client.Write([]byte("x")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case <-done:
+				t.Fatal("relay closed an active connection")
+			default:
+			}
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("relay did not close the idle connection")
+			}
+			if r := tr.reason.Load(); r == nil || *r != closeIdle {
+				t.Fatalf("close reason = %v, want %q", r, closeIdle)
+			}
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := client.Read(make([]byte, 1)); err == nil {
+				t.Fatal("client connection still open after idle timeout")
+			}
+		})
+	}
+}
+
+// TestRelayWriteStall 目标一直不读数据时,超过写入超时关闭连接
+func TestRelayWriteStall(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		wrap bool
+	}{{"splice", false}, {"buffered", true}} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, proxyIn := tcpPair(t)
+			proxyOut, _ := tcpPair(t)
+			tr := &tracked{stats: &ruleStats{}}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				in, out := proxyIn, proxyOut
+				if tc.wrap {
+					in, out = plainConn{proxyIn}, plainConn{proxyOut}
+				}
+				relay(in, out, TCP_TIMEOUT, 200*time.Millisecond, tr, 0)
+			}()
+			// 写满两端的缓冲区,relay的写入阻塞
+			go func() {
+				buf := make([]byte, 64*1024)
+				for {
+					if _, err := client.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("relay did not close the stalled connection")
+			}
+			if r := tr.reason.Load(); r == nil || *r != closeStalled {
+				t.Fatalf("close reason = %v, want %q", r, closeStalled)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// router 一个监听端口的路由表,没有匹配的路由时使用def
+type router struct {
+	routes []hostRoute
+	def    *balancer
+}
+
+type hostRoute struct {
+	host  string // 空为所有主机名
+	path  string // http协议的路径前缀,空为所有路径
+	strip bool
+	lb    *balancer
+}
+
+// match 先比较主机名:精确匹配优先,其次是后缀最长的通配 *.example.com,最后是不限主机名的路由;
+// 主机名相同时路径前缀最长的优先。sni协议传入空路径,只匹配没有路径前缀的路由。没有匹配时返回nil
+func (rt *router) match(host, path string) *hostRoute {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	var best *hostRoute
+	bestHost, bestPath := -1, -1
+	for i := range rt.routes {
+		route := &rt.routes[i]
+		rank := hostRank(route.host, host)
+		if rank < 0 || !pathMatch(route.path, path) {
+			continue
+		}
+		if rank > bestHost || (rank == bestHost && len(route.path) > bestPath) {
+			best, bestHost, bestPath = route, rank, len(route.path)
+		}
+	}
+	return best
+}
+
+// balancer 返回匹配的路由的负载均衡器,没有匹配时返回默认的
+func (rt *router) balancer(host, path string) *balancer {
+	if route := rt.match(host, path); route != nil {
+		return route.lb
+	}
+	return rt.def
+}
+
+// hostRank 主机名的匹配程度,不匹配返回-1
+func hostRank(pattern, host string) int {
+	if pattern == "" {
+		return 0
+	}
+	if host == "" {
+		return -1
+	}
+	if pattern == host {
+		return math.MaxInt
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasSuffix(host, suffix) {
+		return len(suffix)
+	}
+	return -1
+}
+
+// pathMatch 按路径段匹配前缀,/api 匹配 /api 和 /api/x,不匹配 /apix
+func pathMatch(prefix, path string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// newRouter 按端口偏移生成路由表,每条路由的目标单独负载均衡和健康检查
+func (r *rule) newRouter(def *balancer, offset int) (*router, error) {
+	rt := &router{def: def}
+	if r.cfg.Protocol != "sni" && r.cfg.Protocol != "http" {
+		return rt, nil
+	}
+	for _, route := range r.routes {
+		addr, err := offsetAddr(route.Target, offset)
+		if err != nil {
+			return nil, err
+		}
+		lb := r.addBalancer(newBalancer(r.cfg.Balance, []string{addr}))
+		rt.routes = append(rt.routes, hostRoute{
+			host:  strings.ToLower(route.Host),
+			path:  strings.TrimSuffix(route.Path, "/"),
+			strip: route.StripPrefix,
+			lb:    lb,
+		})
+	}
+	return rt, nil
+}
+
+// routeAddrs 同样替换路由目标中的127.0.0.1
+func routeAddrs(routes []config.Route, wslIP string) []config.Route {
+	addrs := make([]string, len(routes))
+	for i, route := range routes {
+		addrs[i] = route.Target
+	}
+	addrs = targetAddrs(addrs, wslIP)
+	list := make([]config.Route, len(routes))
+	for i, route := range routes {
+		list[i] = route
+		list[i].Target = addrs[i]
+	}
+	return list
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// peekSNI 读取TLS ClientHello中的主机名但不完成握手,
+// 返回已读到的数据,这些数据要原样发给目标;不是TLS时主机名为空
+func peekSNI(c net.Conn, prefix []byte) (string, []byte, error) {
+	c.SetReadDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	var buf bytes.Buffer
+	r := io.TeeReader(io.MultiReader(bytes.NewReader(prefix), c), &buf)
+	var host string
+	err := tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			host = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if host == "" && err != nil && !errors.Is(err, errHelloRead) {
+		// 读取出错(超时、断开)时放弃这个连接,格式不对时按没有主机名处理
+		var netErr net.Error
+		if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", nil, err
+		}
+	}
+	return host, buf.Bytes(), nil
+}
+
+// readOnlyConn 只用于解析ClientHello,写入被丢弃
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// clientHello 抓取一个真实的ClientHello记录
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tls.Client(c, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		c.Close()
+	}()
+	buf := make([]byte, 64*1024)
+	n, err := s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestPeekSNI(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	noSNI := clientHello(t, "")
+	for _, tc := range []struct {
+		name    string
+		prefix  []byte // readProxyHeader多读到的数据
+		in      []byte
+		host    string
+		wantErr bool
+	}{
+		{name: "sni", in: hello, host: "example.com"},
+		{name: "prefix", prefix: hello[:7], in: hello[7:], host: "example.com"},
+		{name: "no sni", in: noSNI},
+		{name: "not tls", in: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")},
+		{name: "truncated", in: hello[:len(hello)/2], wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(tc.in)
+				client.Close()
+			}()
+			host, data, err := peekSNI(server, tc.prefix)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("host %q, want error", host)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tc.host {
+				t.Errorf("host = %q, want %q", host, tc.host)
+			}
+			// 读到的数据要原样发给目标
+			want := append(append([]byte(nil), tc.prefix...), tc.in...)
+			if !bytes.HasPrefix(want, data) || len(data) == 0 {
+				t.Errorf("data = %q, want prefix of %q", data, want)
+			}
+		})
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	routes := []hostRoute{
+		{host: "example.com"},
+		{host: "example.com", path: "/api"},
+		{host: "example.com", path: "/api/v2"},
+		{host: "*.example.com"},
+		{host: "*.a.example.com"},
+		{path: "/static"},
+	}
+	rt := &router{def: &balancer{id: -1}}
+	for i, route := range routes {
+		route.lb = &balancer{id: i}
+		rt.routes = append(rt.routes, route)
+	}
+	for _, tc := range []struct {
+		host, path string
+		want       int // 路由序号,-1为默认目标
+	}{
+		{"example.com", "/", 0},
+		{"EXAMPLE.com.", "/", 0},
+		{"example.com", "/api", 1},
+		{"example.com", "/api/users", 1},
+		{"example.com", "/apix", 0},
+		{"example.com", "/api/v2/x", 2},
+		{"www.example.com", "/api", 3},
+		{"x.a.example.com", "/", 4},
+		{"a.example.com", "/", 3},
+		{"other.org", "/static/app.js", 5},
+		{"other.org", "/", -1},
+		{"", "/static", 5},
+		// sni协议没有路径,不匹配带路径前缀的路由
+		{"example.com", "", 0},
+		{"other.org", "", -1},
+	} {
+		if got := rt.balancer(tc.host, tc.path).id; got != tc.want {
+			t.Errorf("match(%q, %q) = %d, want %d", tc.host, tc.path, got, tc.want)
+		}
+	}
+}
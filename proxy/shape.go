@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"reflect"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+const (
+	shapeBurst = 64 * 1024 // 限速令牌桶的最小突发字节数,要能放下一个UDP报文
+	shapeChunk = 16 * 1024 // 限速时TCP每次最多读取的字节数,让流量更平滑
+)
+
+// shaper 规则的带宽限制:上传(客户端->目标)和下载(目标->客户端)各有一个规则共用的令牌桶,
+// 每条连接另有自己的桶;速率为0时不限制,修改后正在转发的连接马上使用新速率
+type shaper struct {
+	up, down *tokenBucket
+	connRate int // 每条连接每个方向的KB/s,由rule.mu保护
+}
+
+// bandwidth 把KB/s换算成令牌桶的速率和突发字节数
+func bandwidth(kbps int) (rate, burst float64) {
+	rate = float64(kbps) * 1024
+	return rate, max(rate, shapeBurst)
+}
+
+func newBandwidthBucket(kbps int) *tokenBucket {
+	return newTokenBucket(bandwidth(kbps))
+}
+
+func newShaper(cfg *config.ProxyConfig) *shaper {
+	return &shaper{
+		up:       newBandwidthBucket(cfg.UploadRate),
+		down:     newBandwidthBucket(cfg.DownloadRate),
+		connRate: cfg.ConnRate,
+	}
+}
+
+// setBandwidth 运行中修改限速,不断开连接
+func (r *rule) setBandwidth(cfg *config.ProxyConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg.UploadRate, r.cfg.DownloadRate, r.cfg.ConnRate = cfg.UploadRate, cfg.DownloadRate, cfg.ConnRate
+	r.shaper.up.setRate(bandwidth(cfg.UploadRate))
+	r.shaper.down.setRate(bandwidth(cfg.DownloadRate))
+	r.shaper.connRate = cfg.ConnRate
+	for _, t := range r.conns {
+		t.up.setRate(bandwidth(cfg.ConnRate))
+		t.down.setRate(bandwidth(cfg.ConnRate))
+	}
+}
+
+// config 返回规则当前的配置
+func (r *rule) config() config.ProxyConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
+}
+
+// onlyBandwidthChanged 两份配置除带宽限制外都相同
+func onlyBandwidthChanged(old config.ProxyConfig, cfg *config.ProxyConfig) bool {
+	updated := *cfg
+	for _, c := range []*config.ProxyConfig{&old, &updated} {
+		c.UploadRate, c.DownloadRate, c.ConnRate, c.Status = 0, 0, 0, false
+	}
+	return reflect.DeepEqual(old, updated)
+}
+
+// shapeChunk 限速时TCP每次读取的上限,不限速时为0,可以使用splice
+func (r *rule) shapeChunk() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cfg.UploadRate <= 0 && r.cfg.DownloadRate <= 0 && r.shaper.connRate <= 0 {
+		return 0
+	}
+	return shapeChunk
+}
+
+// waitIn 客户端->目标转发了n字节后,按规则和连接的限速等待;规则停止时不再等待
+func (t *tracked) waitIn(n int64) {
+	if t.shaper == nil {
+		return
+	}
+	if t.shaper.up.take(float64(n), t.done) {
+		t.up.take(float64(n), t.done)
+	}
+}
+
+// waitOut 目标->客户端转发了n字节后,按规则和连接的限速等待
+func (t *tracked) waitOut(n int64) {
+	if t.shaper == nil {
+		return
+	}
+	if t.shaper.down.take(float64(n), t.done) {
+		t.down.take(float64(n), t.done)
+	}
+}
+
+// allowIn UDP报文没有流控,超过限速的报文直接丢弃
+func (t *tracked) allowIn(n int) bool {
+	if t.shaper == nil {
+		return true
+	}
+	return t.shaper.up.tryTake(float64(n)) && t.up.tryTake(float64(n))
+}
+
+func (t *tracked) allowOut(n int) bool {
+	if t.shaper == nil {
+		return true
+	}
+	return t.shaper.down.tryTake(float64(n)) && t.down.tryTake(float64(n))
+}
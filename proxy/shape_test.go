@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// takeAsync 在另一个协程里take,返回结果的通道
+func takeAsync(b *tokenBucket, n float64, done <-chan struct{}) <-chan bool {
+	res := make(chan bool, 1)
+	go func() { res <- b.take(n, done) }()
+	return res
+}
+
+func TestTokenBucketTakeRateChange(t *testing.T) {
+	b := newTokenBucket(100, 100)
+	if !b.take(100, nil) {
+		t.Fatal("take within burst failed")
+	}
+	res := takeAsync(b, 100, nil) // 100/s时要等1秒
+	time.Sleep(50 * time.Millisecond)
+
+	// 降低速率后还要等更久
+	b.setRate(10, 10)
+	select {
+	case <-res:
+		t.Fatal("take finished right after lowering the rate")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// 提高速率后马上按新速率完成,不用等旧速率下预留的时间
+	b.setRate(1<<20, 1<<20)
+	select {
+	case ok := <-res:
+		if !ok {
+			t.Fatal("take returned false")
+		}
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("take still waiting after raising the rate")
+	}
+
+	// 速率为0时不限制
+	b.setRate(0, 0)
+	start := time.Now()
+	if !b.take(1e9, nil) || time.Since(start) > 10*time.Millisecond {
+		t.Fatal("rate 0 must not wait")
+	}
+}
+
+func TestTokenBucketTakeDone(t *testing.T) {
+	b := newTokenBucket(1, 1)
+	b.take(1, nil)
+	done := make(chan struct{})
+	res := takeAsync(b, 10, done)
+	close(done)
+	select {
+	case ok := <-res:
+		if ok {
+			t.Fatal("take returned true after done was closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("take ignored done")
+	}
+}
+
+// TestOnlyBandwidthChanged 界面直接修改配置的切片元素时,规则的配置快照不能跟着变
+func TestOnlyBandwidthChanged(t *testing.T) {
+	cfg := &config.ProxyConfig{ID: "bw", Protocol: "tcp", TargetAddr: "127.0.0.1:80",
+		Targets: []string{"127.0.0.1:81"}, AllowIPs: []string{"10.0.0.0/8"}}
+	r := newTestRule(cfg)
+
+	cfg.UploadRate = 100
+	if !onlyBandwidthChanged(r.config(), cfg) {
+		t.Fatal("bandwidth change not detected as bandwidth only")
+	}
+	cfg.Targets[0] = "127.0.0.1:82"
+	if onlyBandwidthChanged(r.config(), cfg) {
+		t.Fatal("edited target treated as a bandwidth change")
+	}
+	if r.cfg.Targets[0] != "127.0.0.1:81" {
+		t.Fatalf("rule snapshot changed to %v", r.cfg.Targets)
+	}
+	cfg.Targets[0] = "127.0.0.1:81"
+	cfg.AllowIPs[0] = "192.168.0.0/16"
+	if onlyBandwidthChanged(r.config(), cfg) {
+		t.Fatal("edited allow list treated as a bandwidth change")
+	}
+}
@@ -0,0 +1,422 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const socksHandshakeTimeout = 10 * time.Second
+
+// SOCKS5 命令、地址类型和应答码
+const (
+	socksVer       = 0x05
+	socksAuthVer   = 0x01 // RFC 1929 用户名密码认证的版本
+	socksNoAuth    = 0x00
+	socksUserPass  = 0x02
+	socksNoMethod  = 0xff
+	socksConnect   = 0x01
+	socksAssociate = 0x03
+	socksIPv4      = 0x01
+	socksDomain    = 0x03
+	socksIPv6      = 0x04
+
+	socksSucceeded      = 0x00
+	socksFailure        = 0x01
+	socksNotAllowed     = 0x02
+	socksHostUnreach    = 0x04
+	socksRefused        = 0x05
+	socksCmdUnsupported = 0x07
+	socksAddrUnsupport  = 0x08
+)
+
+var errSocksAuth = errors.New("socks5 authentication failed")
+
+// serveSOCKS5 完成SOCKS5握手,CONNECT走和静态TCP规则相同的转发,UDP ASSOCIATE在TCP连接存活期间转发报文
+func (r *rule) serveSOCKS5(c net.Conn, client net.Addr, t *tracked) {
+	c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	if err := r.socksAuth(c); err != nil {
+		log.Printf("SOCKS5 %s err: %v\r\n", client, err)
+		return
+	}
+	var hdr [3]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil || hdr[0] != socksVer {
+		return
+	}
+	host, port, err := readSocksAddr(c)
+	if err != nil {
+		socksReply(c, socksAddrUnsupport, nil)
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	switch hdr[1] {
+	case socksConnect:
+		r.socksConnect(c, t, host, port)
+	case socksAssociate:
+		r.socksAssociate(c, client, t)
+	default:
+		socksReply(c, socksCmdUnsupported, nil)
+	}
+}
+
+// socksAuth 协商认证方式,配置了用户名时要求用户名密码认证(RFC 1929)
+func (r *rule) socksAuth(c net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVer {
+		return fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+	want := byte(socksNoAuth)
+	if r.cfg.ProxyUser != "" {
+		want = socksUserPass
+	}
+	found := false
+	for _, m := range methods {
+		found = found || m == want
+	}
+	if !found {
+		c.Write([]byte{socksVer, socksNoMethod})
+		return errSocksAuth
+	}
+	if _, err := c.Write([]byte{socksVer, want}); err != nil {
+		return err
+	}
+	if want == socksNoAuth {
+		return nil
+	}
+
+	// ver ulen uname plen passwd
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksAuthVer {
+		c.Write([]byte{socksAuthVer, 0x01})
+		return fmt.Errorf("unsupported auth version %d", hdr[0])
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, hdr[:1]); err != nil {
+		return err
+	}
+	pass := make([]byte, hdr[0])
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return err
+	}
+	if !r.checkProxyAuth(string(user), string(pass)) {
+		c.Write([]byte{socksAuthVer, 0x01})
+		return errSocksAuth
+	}
+	_, err := c.Write([]byte{socksAuthVer, 0x00})
+	return err
+}
+
+// checkProxyAuth 用固定时间比较用户名密码
+func (r *rule) checkProxyAuth(user, pass string) bool {
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(r.cfg.ProxyUser))
+	p := subtle.ConstantTimeCompare([]byte(pass), []byte(r.cfg.ProxyPass))
+	return u&p == 1
+}
+
+func (r *rule) socksConnect(c net.Conn, t *tracked, host string, port int) {
+	dst, err := r.dialDest(t, host, port)
+	if err != nil {
+		socksReply(c, socksReplyCode(err), nil)
+		return
+	}
+	defer dst.Close()
+	if err := socksReply(c, socksSucceeded, dst.LocalAddr()); err != nil {
+		return
+	}
+	relay(c, dst, r.tcpTimeout(), r.writeTimeout(), t, r.shapeChunk())
+}
+
+// socksAssociate 为客户端开一个UDP端口,客户端发来的报文去掉SOCKS头后由另一个端口发给目标,
+// 只接受发送过报文的目标的响应;控制连接关闭或空闲超时后结束
+func (r *rule) socksAssociate(c net.Conn, client net.Addr, t *tracked) {
+	localIP := c.LocalAddr().(*net.TCPAddr).IP
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		socksReply(c, socksFailure, nil)
+		return
+	}
+	defer relayConn.Close()
+	out, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		socksReply(c, socksFailure, nil)
+		return
+	}
+	defer out.Close()
+	target := "udp " + relayConn.LocalAddr().String()
+	if !r.attach(t, relayConn, target) || !r.attach(t, out, target) {
+		return
+	}
+	if err := socksReply(c, socksSucceeded, relayConn.LocalAddr()); err != nil {
+		return
+	}
+
+	// 开启AcceptProxy时c的对端是前置代理,UDP报文由真实客户端直接发来
+	peerIP, _ := addrIPPort(client)
+	a := &socksAssoc{
+		r:         r,
+		t:         t,
+		ctrl:      c,
+		relayConn: relayConn,
+		out:       out,
+		peerIP:    peerIP,
+		dests:     make(map[string]bool),
+		resolved:  make(map[string]*net.UDPAddr),
+	}
+	go a.fromClient()
+	go a.fromDest()
+	// 控制连接上不应再有数据,读到EOF或出错说明客户端结束了关联
+	io.Copy(io.Discard, c)
+}
+
+type socksAssoc struct {
+	r         *rule
+	t         *tracked
+	ctrl      net.Conn     // 控制连接,UDP空闲超时后关闭
+	relayConn *net.UDPConn // 和客户端通信
+	out       *net.UDPConn // 和目标通信
+	peerIP    net.IP       // 只接受控制连接对端IP发来的报文
+
+	mu       sync.Mutex
+	clientUD *net.UDPAddr            // 客户端的UDP地址,收到第一个报文后确定
+	dests    map[string]bool         // 发送过报文的目标
+	resolved map[string]*net.UDPAddr // 目标主机名解析缓存
+}
+
+// idle 读取出错或空闲超过UDP超时时返回true
+func (a *socksAssoc) idle(err error) bool {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	timeout := a.r.udpTimeout()
+	if timeout > 0 && time.Since(time.Unix(0, a.t.lastActive())) >= timeout {
+		a.t.setReason(closeIdle)
+		return true
+	}
+	return false
+}
+
+func (a *socksAssoc) setDeadline(c *net.UDPConn) {
+	if timeout := a.r.udpTimeout(); timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+func (a *socksAssoc) fromClient() {
+	defer a.ctrl.Close()
+	defer a.out.Close()
+	bufp := udpBufPool.Get().(*[]byte)
+	defer udpBufPool.Put(bufp)
+	for {
+		a.setDeadline(a.relayConn)
+		n, from, err := a.relayConn.ReadFromUDP(*bufp)
+		if err != nil {
+			if a.idle(err) {
+				return
+			}
+			continue
+		}
+		if !from.IP.Equal(a.peerIP) {
+			continue
+		}
+		a.mu.Lock()
+		if a.clientUD == nil {
+			a.clientUD = from
+		}
+		ok := a.clientUD.String() == from.String()
+		a.mu.Unlock()
+		if !ok {
+			continue
+		}
+		dest, payload, err := a.parse((*bufp)[:n])
+		if err != nil {
+			continue
+		}
+		if !a.t.allowIn(len(payload)) {
+			continue
+		}
+		if _, err := a.out.WriteToUDP(payload, dest); err != nil {
+			continue
+		}
+		a.t.tapIn(payload)
+		a.t.addIn(int64(len(payload)))
+	}
+}
+
+// parse 解析客户端报文的SOCKS头,检查目标并返回目标地址和数据;不支持分片
+func (a *socksAssoc) parse(b []byte) (*net.UDPAddr, []byte, error) {
+	if len(b) < 4 || b[2] != 0 {
+		return nil, nil, errors.New("fragmented or short packet")
+	}
+	r := &byteReader{b: b[3:]}
+	host, port, err := readSocksAddr(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+	a.mu.Lock()
+	dest, ok := a.resolved[key]
+	a.mu.Unlock()
+	if !ok {
+		addr, err := a.r.resolveDest(host, port)
+		if err != nil {
+			log.Printf("SOCKS5 UDP %s -> %s err: %v\r\n", a.t.client, key, err)
+			return nil, nil, err
+		}
+		if dest, err = net.ResolveUDPAddr("udp", addr); err != nil {
+			return nil, nil, err
+		}
+		a.mu.Lock()
+		a.resolved[key] = dest
+		a.dests[dest.String()] = true
+		a.mu.Unlock()
+	}
+	return dest, r.b, nil
+}
+
+func (a *socksAssoc) fromDest() {
+	defer a.ctrl.Close()
+	defer a.relayConn.Close()
+	bufp := udpBufPool.Get().(*[]byte)
+	defer udpBufPool.Put(bufp)
+	buf := *bufp
+	for {
+		a.setDeadline(a.out)
+		// 前面留出SOCKS头的位置: RSV(2) FRAG(1) ATYP(1) IPv6(16) PORT(2)
+		n, from, err := a.out.ReadFromUDP(buf[22:])
+		if err != nil {
+			if a.idle(err) {
+				return
+			}
+			continue
+		}
+		a.mu.Lock()
+		known, clientUD := a.dests[from.String()], a.clientUD
+		a.mu.Unlock()
+		if !known || clientUD == nil {
+			continue
+		}
+		if !a.t.allowOut(n) {
+			continue
+		}
+		hdr := socksUDPHeader(from)
+		start := 22 - len(hdr)
+		copy(buf[start:], hdr)
+		if _, err := a.relayConn.WriteToUDP(buf[start:22+n], clientUD); err != nil {
+			continue
+		}
+		a.t.tapOut(buf[22 : 22+n])
+		a.t.addOut(int64(n))
+	}
+}
+
+func socksUDPHeader(addr *net.UDPAddr) []byte {
+	hdr := []byte{0, 0, 0}
+	return appendSocksAddr(hdr, addr.IP, addr.Port)
+}
+
+// readSocksAddr 读取 ATYP DST.ADDR DST.PORT
+func readSocksAddr(r io.Reader) (string, int, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, 4)
+		if atyp[0] == socksIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+func appendSocksAddr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socksIPv4), ip4...)
+	} else {
+		b = append(append(b, socksIPv6), ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// socksReply 发送应答,bound为空时填0.0.0.0:0
+func socksReply(c net.Conn, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero, 0
+	if a, p := addrIPPort(bound); a != nil {
+		ip, port = a, p
+	}
+	_, err := c.Write(appendSocksAddr([]byte{socksVer, code, 0}, ip, port))
+	return err
+}
+
+func socksReplyCode(err error) byte {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errDestDenied):
+		return socksNotAllowed
+	case errors.As(err, &dnsErr):
+		return socksHostUnreach
+	case errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout():
+		return socksRefused
+	case errors.As(err, &opErr) && opErr.Timeout():
+		return socksHostUnreach
+	}
+	return socksFailure
+}
+
+// byteReader 从字节切片读取,读完后b是剩下的数据
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
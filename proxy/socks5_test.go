@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+func newTestRule(cfg *config.ProxyConfig) *rule {
+	return newRule(cfg, new(atomic.Pointer[globalSettings]), nil, &ruleStats{})
+}
+
+// userPass RFC 1929 用户名密码认证请求
+func userPass(ver byte, user, pass string) []byte {
+	b := append([]byte{ver, byte(len(user))}, user...)
+	return append(append(b, byte(len(pass))), pass...)
+}
+
+func TestSocksAuth(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		user    string
+		in      []byte
+		reply   []byte
+		wantErr bool
+	}{
+		{name: "no auth", in: []byte{5, 1, 0}, reply: []byte{5, 0}},
+		{name: "no auth among methods", in: []byte{5, 2, 2, 0}, reply: []byte{5, 0}},
+		{name: "no acceptable method", in: []byte{5, 1, 2}, reply: []byte{5, 0xff}, wantErr: true},
+		{name: "socks4", in: []byte{4, 1, 0}, wantErr: true},
+		{name: "user pass", user: "user", in: append([]byte{5, 1, 2}, userPass(1, "user", "pass")...),
+			reply: []byte{5, 2, 1, 0}},
+		{name: "wrong pass", user: "user", in: append([]byte{5, 1, 2}, userPass(1, "user", "nope")...),
+			reply: []byte{5, 2, 1, 1}, wantErr: true},
+		{name: "bad auth version", user: "user", in: append([]byte{5, 1, 2}, userPass(5, "user", "pass")...),
+			reply: []byte{5, 2, 1, 1}, wantErr: true},
+		{name: "auth required", user: "user", in: []byte{5, 1, 0}, reply: []byte{5, 0xff}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRule(&config.ProxyConfig{Protocol: "socks5", ProxyUser: tc.user, ProxyPass: "pass"})
+			client, server := tcpPair(t)
+			if _, err := client.Write(tc.in); err != nil {
+				t.Fatal(err)
+			}
+			err := r.socksAuth(server)
+			server.Close()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tc.wantErr)
+			}
+			reply, _ := io.ReadAll(client)
+			if !bytes.Equal(reply, tc.reply) {
+				t.Errorf("reply = %v, want %v", reply, tc.reply)
+			}
+		})
+	}
+}
+
+func TestSocksAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		in      []byte
+		host    string
+		port    int
+		wantErr bool
+	}{
+		{name: "ipv4", in: []byte{1, 192, 0, 2, 1, 0, 80}, host: "192.0.2.1", port: 80},
+		{name: "ipv6", in: append(append([]byte{4}, net.ParseIP("2001:db8::1")...), 1, 187), host: "2001:db8::1", port: 443},
+		{name: "domain", in: append(append([]byte{3, 11}, "example.com"...), 0x1f, 0x90), host: "example.com", port: 8080},
+		{name: "short", in: []byte{1, 192, 0, 2}, wantErr: true},
+		{name: "bad type", in: []byte{2, 0, 0}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			host, port, err := readSocksAddr(bytes.NewReader(tc.in))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tc.wantErr)
+			}
+			if host != tc.host || port != tc.port {
+				t.Errorf("got %s:%d, want %s:%d", host, port, tc.host, tc.port)
+			}
+		})
+	}
+}
+
+func TestSocksUDPFraming(t *testing.T) {
+	r := newTestRule(&config.ProxyConfig{Protocol: "socks5"})
+	r.allowDest = newDestFilter([]string{"192.0.2.0/24"})
+	a := &socksAssoc{r: r, t: &tracked{}, dests: make(map[string]bool), resolved: make(map[string]*net.UDPAddr)}
+	dest := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 53}
+	for _, tc := range []struct {
+		name    string
+		in      []byte
+		payload string
+		wantErr bool
+	}{
+		{name: "datagram", in: append(socksUDPHeader(dest), "query"...), payload: "query"},
+		{name: "empty payload", in: socksUDPHeader(dest)},
+		{name: "fragment", in: append([]byte{0, 0, 1}, socksUDPHeader(dest)[3:]...), wantErr: true},
+		{name: "short", in: []byte{0, 0, 0}, wantErr: true},
+		{name: "denied", in: append(socksUDPHeader(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 53}), "x"...), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, payload, err := a.parse(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if got.String() != dest.String() || string(payload) != tc.payload {
+				t.Errorf("got %v %q, want %v %q", got, payload, dest, tc.payload)
+			}
+			if !a.dests[dest.String()] {
+				t.Error("destination not recorded for responses")
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats 单条规则的流量统计快照
+type Stats struct {
+	BytesIn      int64 // 客户端 -> 目标
+	BytesOut     int64 // 目标 -> 客户端
+	ActiveConns  int64 // 当前连接数(含UDP会话)
+	TotalConns   int64
+	DialFailures int64
+	UDPSessions  int64 // 当前UDP会话数
+	Denied       int64 // 客户端IP被拒绝的次数
+	Limited      int64 // 超过连接数或接受速率限制被拒绝的次数
+	Queued       int64 // 超过限制后排队等待的次数
+}
+
+// ConnInfo 连接表中的一条活动连接
+type ConnInfo struct {
+	ID         uint64
+	Protocol   string
+	ClientAddr string
+	TargetAddr string
+	Start      time.Time
+	LastActive time.Time
+	BytesIn    int64
+	BytesOut   int64
+}
+
+// DestStats 客户端指定目标的协议(socks5/http-connect)按目标统计的流量
+type DestStats struct {
+	Dest         string // 客户端请求的 host:port
+	BytesIn      int64
+	BytesOut     int64
+	ActiveConns  int64
+	TotalConns   int64
+	DialFailures int64
+}
+
+func (d DestStats) String() string {
+	return fmt.Sprintf("%s ↑%s ↓%s %d/%d ✗%d", d.Dest, FormatBytes(d.BytesIn), FormatBytes(d.BytesOut),
+		d.ActiveConns, d.TotalConns, d.DialFailures)
+}
+
+func (c ConnInfo) String() string {
+	return fmt.Sprintf("#%d %s %s → %s %s ↑%s ↓%s", c.ID, c.Protocol, c.ClientAddr, c.TargetAddr,
+		c.Start.Format("15:04:05"), FormatBytes(c.BytesIn), FormatBytes(c.BytesOut))
+}
+
+type ruleStats struct {
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	activeConns  atomic.Int64
+	totalConns   atomic.Int64
+	dialFailures atomic.Int64
+	udpSessions  atomic.Int64
+	denied       atomic.Int64
+	limited      atomic.Int64
+	queued       atomic.Int64
+
+	destMu sync.Mutex
+	dests  map[string]*destStats
+}
+
+// maxDestStats 按目标统计的最大条数,超过后新目标合并到 "*"
+const maxDestStats = 1024
+
+type destStats struct {
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	activeConns  atomic.Int64
+	totalConns   atomic.Int64
+	dialFailures atomic.Int64
+}
+
+// dest 返回目标的统计,不存在时创建
+func (s *ruleStats) dest(dest string) *destStats {
+	s.destMu.Lock()
+	defer s.destMu.Unlock()
+	if s.dests == nil {
+		s.dests = make(map[string]*destStats)
+	}
+	d, ok := s.dests[dest]
+	if !ok {
+		if len(s.dests) >= maxDestStats {
+			if d, ok = s.dests["*"]; ok {
+				return d
+			}
+			dest = "*"
+		}
+		d = &destStats{}
+		s.dests[dest] = d
+	}
+	return d
+}
+
+func (s *ruleStats) destSnapshot() []DestStats {
+	s.destMu.Lock()
+	list := make([]DestStats, 0, len(s.dests))
+	for dest, d := range s.dests {
+		list = append(list, DestStats{
+			Dest:         dest,
+			BytesIn:      d.bytesIn.Load(),
+			BytesOut:     d.bytesOut.Load(),
+			ActiveConns:  d.activeConns.Load(),
+			TotalConns:   d.totalConns.Load(),
+			DialFailures: d.dialFailures.Load(),
+		})
+	}
+	s.destMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Dest < list[j].Dest })
+	return list
+}
+
+func (s *ruleStats) snapshot() Stats {
+	return Stats{
+		BytesIn:      s.bytesIn.Load(),
+		BytesOut:     s.bytesOut.Load(),
+		ActiveConns:  s.activeConns.Load(),
+		TotalConns:   s.totalConns.Load(),
+		DialFailures: s.dialFailures.Load(),
+		UDPSessions:  s.udpSessions.Load(),
+		Denied:       s.denied.Load(),
+		Limited:      s.limited.Load(),
+		Queued:       s.queued.Load(),
+	}
+}
+
+var connID atomic.Uint64
+
+// tracked 规则下的一条活动连接(TCP连接或UDP会话)
+type tracked struct {
+	id         uint64
+	rule       string // 规则ID,写访问日志用
+	protocol   string
+	client     string
+	clientAddr net.Addr
+	peerAddr   net.Addr // 实际连接的目标地址,抓包使用
+	start      time.Time
+	last       atomic.Int64 // 最后一次收发数据的时间
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	stats      *ruleStats
+	dest       *destStats // 客户端指定目标的协议才有
+	shaper     *shaper    // 规则共用的限速
+	tap        *ruleTap
+	// 调试日志已经记录的字节数,每个方向只在自己的转发协程里修改
+	dumpedIn, dumpedOut int
+	reason              atomic.Pointer[string] // 关闭原因,为空时是正常结束
+	target              atomic.Pointer[string] // 目标地址,http协议每个请求更新,转发协程同时在读
+	up, down            *tokenBucket
+	done                <-chan struct{} // 规则停止时关闭,限速等待用
+	conns               []net.Conn      // 规则停止时需要关闭的连接
+}
+
+func (t *tracked) addIn(n int64) {
+	t.bytesIn.Add(n)
+	t.stats.bytesIn.Add(n)
+	if t.dest != nil {
+		t.dest.bytesIn.Add(n)
+	}
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *tracked) addOut(n int64) {
+	t.bytesOut.Add(n)
+	t.stats.bytesOut.Add(n)
+	if t.dest != nil {
+		t.dest.bytesOut.Add(n)
+	}
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *tracked) lastActive() int64 {
+	return t.last.Load()
+}
+
+func (t *tracked) info() ConnInfo {
+	return ConnInfo{
+		ID:         t.id,
+		Protocol:   t.protocol,
+		ClientAddr: t.client,
+		TargetAddr: t.targetAddr(),
+		Start:      t.start,
+		LastActive: time.Unix(0, t.last.Load()),
+		BytesIn:    t.bytesIn.Load(),
+		BytesOut:   t.bytesOut.Load(),
+	}
+}
+
+// open 在连接表中登记一条新连接,规则已停止时返回nil
+func (r *rule) open(client net.Addr, target string, c net.Conn) *tracked {
+	t := &tracked{
+		id:         connID.Add(1),
+		rule:       r.cfg.ID,
+		protocol:   r.cfg.Protocol,
+		client:     client.String(),
+		clientAddr: client,
+		start:      time.Now(),
+		stats:      r.stats,
+	}
+	t.last.Store(t.start.UnixNano())
+	t.setTarget(target)
+	if c != nil {
+		t.conns = append(t.conns, c)
+		if target != "" {
+			t.peerAddr = c.RemoteAddr() // UDP会话打开时就连接了目标
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	t.shaper = r.shaper
+	t.done = r.done
+	t.tap = r.tap
+	t.up, t.down = newBandwidthBucket(r.shaper.connRate), newBandwidthBucket(r.shaper.connRate)
+	r.conns[t.id] = t
+	r.stats.activeConns.Add(1)
+	r.stats.totalConns.Add(1)
+	if r.cfg.Protocol == "udp" {
+		r.stats.udpSessions.Add(1)
+	}
+	return t
+}
+
+// attach 把目标连接挂到t上并记录实际连接的目标,规则已停止时返回false
+func (r *rule) attach(t *tracked, c net.Conn, target string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	t.conns = append(t.conns, c)
+	t.setTarget(target)
+	if addr := c.RemoteAddr(); addr != nil {
+		t.peerAddr = addr
+	}
+	return true
+}
+
+// setTarget 记录目标;连接目标失败时也记录,访问日志里能看到没有连上的目标
+func (t *tracked) setTarget(target string) {
+	t.target.Store(&target)
+}
+
+func (t *tracked) targetAddr() string {
+	if p := t.target.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// trackDest 开始按客户端请求的目标统计t的流量,在连接目标之前调用
+func (r *rule) trackDest(t *tracked, dest string) *destStats {
+	d := r.stats.dest(dest)
+	d.totalConns.Add(1)
+	d.activeConns.Add(1)
+	t.dest = d
+	return d
+}
+
+func (r *rule) close(t *tracked) {
+	r.mu.Lock()
+	delete(r.conns, t.id)
+	r.mu.Unlock()
+	r.stats.activeConns.Add(-1)
+	t.untap()
+	r.access.write(t.record())
+	if t.dest != nil {
+		t.dest.activeConns.Add(-1)
+	}
+	if t.protocol == "udp" {
+		r.stats.udpSessions.Add(-1)
+	}
+}
+
+func (r *rule) connTable() []ConnInfo {
+	r.mu.Lock()
+	list := make([]ConnInfo, 0, len(r.conns))
+	for _, t := range r.conns {
+		list = append(list, t.info())
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// FormatBytes 把字节数格式化成 1.2 MB 这样的可读形式
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
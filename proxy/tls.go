@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+var selfSignedMu sync.Mutex
+
+// loadCert 读取规则配置的证书,没有配置时使用应用配置目录下的自签名证书
+func loadCert(cfg *config.ProxyConfig) (tls.Certificate, error) {
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		return tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	}
+	return selfSignedCert()
+}
+
+// selfSignedCert 读取自签名证书,不存在或已过期时生成新的并保存
+func selfSignedCert() (tls.Certificate, error) {
+	selfSignedMu.Lock()
+	defer selfSignedMu.Unlock()
+	dir := filepath.Join(config.AppDataDir(), "tls")
+	certFile := filepath.Join(dir, "selfsigned.crt")
+	keyFile := filepath.Join(dir, "selfsigned.key")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil && cert.Leaf != nil && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	certPEM, keyPEM, err := generateSelfSigned()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("generated self-signed certificate %s\r\n", certFile)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func generateSelfSigned() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "wslPortForward"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// CertFingerprint 返回规则使用的证书的SHA-256指纹,如 AB:CD:...
+func CertFingerprint(cfg *config.ProxyConfig) (string, error) {
+	cert, err := loadCert(cfg)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// serverTLSConfig tls协议监听使用的配置,规则启动时加载证书
+func serverTLSConfig(cfg *config.ProxyConfig) (*tls.Config, error) {
+	cert, err := loadCert(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// tlsServer 在客户端连接上完成TLS握手,返回解密后的连接
+func tlsServer(c net.Conn, conf *tls.Config) (net.Conn, error) {
+	tc := tls.Server(c, conf)
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// clientTLSConfig 用TLS连接目标时的配置,规则启动时加载CA和客户端证书
+func clientTLSConfig(cfg *config.ProxyConfig) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         cfg.TargetServerName,
+		InsecureSkipVerify: cfg.TargetInsecure,
+	}
+	if cfg.TargetCA != "" {
+		data, err := os.ReadFile(cfg.TargetCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.TargetCA)
+		}
+		conf.RootCAs = pool
+	}
+	if cfg.TargetClientCert != "" || cfg.TargetClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TargetClientCert, cfg.TargetClientKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// tlsClient 在到目标的连接上完成TLS握手,没有设置服务器名时用目标地址的主机名
+func (r *rule) tlsClient(c net.Conn, addr string, timeout time.Duration) (net.Conn, error) {
+	conf := r.targetTLS
+	if conf.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+	tc := tls.Client(c, conf)
+	if timeout > 0 {
+		tc.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// prefixConn 先读出buf中已经读到的数据,再从连接读取
+type prefixConn struct {
+	net.Conn
+	buf []byte
+}
+
+// NetConn 返回底层连接,半关闭时使用
+func (c *prefixConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// useTempAppData 让自签名证书写到临时目录
+func useTempAppData(t *testing.T) string {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("AppData", dir)
+	t.Setenv("HOME", dir)
+	return filepath.Join(config.AppDataDir(), "tls")
+}
+
+// fingerprint 和CertFingerprint相同格式的指纹
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// echoServer 把收到的数据原样发回,ln为nil时监听本地TCP端口
+func echoServer(t *testing.T, ln net.Listener) string {
+	t.Helper()
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// roundTrip 发送msg并读回同样长度的数据
+func roundTrip(c net.Conn, msg string) (string, error) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(c, buf)
+	return string(buf), err
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	dir := useTempAppData(t)
+	fp, err := CertFingerprint(&config.ProxyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "selfsigned.crt"), filepath.Join(dir, "selfsigned.key"))
+	if err != nil {
+		t.Fatalf("saved pair: %v", err)
+	}
+	if want := fingerprint(cert.Certificate[0]); fp != want {
+		t.Fatalf("fingerprint %s, want %s", fp, want)
+	}
+	if len(strings.Split(fp, ":")) != sha256.Size {
+		t.Fatalf("fingerprint %s is not %d hex bytes", fp, sha256.Size)
+	}
+
+	// 再次加载时使用保存的证书
+	again, err := CertFingerprint(&config.ProxyConfig{})
+	if err != nil || again != fp {
+		t.Fatalf("second load %s, %v; want reused %s", again, err, fp)
+	}
+
+	// 证书文件损坏时重新生成
+	if err := os.WriteFile(filepath.Join(dir, "selfsigned.crt"), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	regen, err := CertFingerprint(&config.ProxyConfig{})
+	if err != nil || regen == fp {
+		t.Fatalf("after corruption %s, %v; want a new certificate", regen, err)
+	}
+
+	// 配置了证书文件时使用配置的证书
+	cfg := &config.ProxyConfig{TLSCert: filepath.Join(dir, "selfsigned.crt"), TLSKey: filepath.Join(dir, "selfsigned.key")}
+	if got, err := CertFingerprint(cfg); err != nil || got != regen {
+		t.Fatalf("configured cert %s, %v; want %s", got, err, regen)
+	}
+	cfg.TLSKey = filepath.Join(dir, "missing.key")
+	if _, err := CertFingerprint(cfg); err == nil {
+		t.Fatal("missing key file accepted")
+	}
+}
+
+// TestTLSTermination 客户端 -tls-> 规则 -明文-> 目标
+func TestTLSTermination(t *testing.T) {
+	useTempAppData(t)
+	target := echoServer(t, nil)
+	cfg := &config.ProxyConfig{ID: "tls", Protocol: "tls", ListenAddr: "127.0.0.1", TargetAddr: target}
+	r := newTestRule(cfg)
+	r.targets = []string{target}
+	if err := r.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.stop()
+
+	c, err := tls.Dial("tcp", r.listeners[0].Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fp, err := CertFingerprint(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fingerprint(c.ConnectionState().PeerCertificates[0].Raw); got != fp {
+		t.Fatalf("served certificate %s, want %s", got, fp)
+	}
+	if got, err := roundTrip(c, "hello over tls"); err != nil || got != "hello over tls" {
+		t.Fatalf("echo %q, %v", got, err)
+	}
+
+	// 不是TLS的客户端握手失败,连接被关闭
+	plain, err := net.Dial("tcp", r.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if got, err := roundTrip(plain, "GET / HTTP/1.1\r\n\r\n"); err == nil {
+		t.Fatalf("plaintext client got %q", got)
+	}
+}
+
+// testPKI 测试用的CA、由CA签发的服务器证书(localhost/127.0.0.1)和客户端证书
+type testPKI struct {
+	caFile                string
+	server                tls.Certificate
+	clientCert, clientKey string
+	pool                  *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	p := &testPKI{caFile: filepath.Join(dir, "ca.pem"), pool: x509.NewCertPool()}
+	p.pool.AddCert(ca)
+	writePEM(t, p.caFile, "CERTIFICATE", caDER)
+
+	issue := func(serial int64, eku x509.ExtKeyUsage) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{eku},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der, keyDER
+	}
+	der, keyDER := issue(2, x509.ExtKeyUsageServerAuth)
+	p.server = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: mustParseKey(t, keyDER)}
+	der, keyDER = issue(3, x509.ExtKeyUsageClientAuth)
+	p.clientCert, p.clientKey = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	writePEM(t, p.clientCert, "CERTIFICATE", der)
+	writePEM(t, p.clientKey, "PRIVATE KEY", keyDER)
+	return p
+}
+
+func mustParseKey(t *testing.T, der []byte) any {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTLSOrigination 客户端 -明文-> 规则 -tls-> 目标
+func TestTLSOrigination(t *testing.T) {
+	pki := newTestPKI(t)
+	for _, tc := range []struct {
+		name          string
+		cfg           config.ProxyConfig
+		requireClient bool // 目标要求客户端证书
+		startErr      bool
+		wantErr       bool
+	}{
+		{name: "insecure", cfg: config.ProxyConfig{TargetInsecure: true}},
+		{name: "untrusted", cfg: config.ProxyConfig{}, wantErr: true},
+		{name: "ca bundle", cfg: config.ProxyConfig{TargetCA: pki.caFile}},
+		{name: "server name", cfg: config.ProxyConfig{TargetCA: pki.caFile, TargetServerName: "localhost"}},
+		{name: "wrong server name", cfg: config.ProxyConfig{TargetCA: pki.caFile, TargetServerName: "other.example"}, wantErr: true},
+		{name: "client cert", cfg: config.ProxyConfig{TargetCA: pki.caFile, TargetClientCert: pki.clientCert, TargetClientKey: pki.clientKey},
+			requireClient: true},
+		{name: "client cert missing", cfg: config.ProxyConfig{TargetCA: pki.caFile}, requireClient: true, wantErr: true},
+		{name: "bad ca file", cfg: config.ProxyConfig{TargetCA: pki.clientKey}, startErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srvConf := &tls.Config{Certificates: []tls.Certificate{pki.server}}
+			if tc.requireClient {
+				srvConf.ClientAuth, srvConf.ClientCAs = tls.RequireAndVerifyClientCert, pki.pool
+			}
+			ln, err := tls.Listen("tcp", "127.0.0.1:0", srvConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := echoServer(t, ln)
+
+			cfg := tc.cfg
+			cfg.ID, cfg.Protocol, cfg.ListenAddr, cfg.TargetAddr, cfg.TargetTLS = "origin", "tcp", "127.0.0.1", target, true
+			r := newTestRule(&cfg)
+			r.targets = []string{target}
+			if err := r.start(); tc.startErr != (err != nil) {
+				t.Fatalf("start err = %v, want error %v", err, tc.startErr)
+			}
+			if tc.startErr {
+				return
+			}
+			defer r.stop()
+
+			c, err := net.Dial("tcp", r.listeners[0].Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			got, err := roundTrip(c, "hello target")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("echo %q, want failure", got)
+				}
+				return
+			}
+			if err != nil || got != "hello target" {
+				t.Fatalf("echo %q, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultMaxUDPSessions = 1024
+
+var udpBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 65507) // UDP 最大报文长度
+		return &buf
+	},
+}
+
+// maxPendingPackets 连接目标期间每个会话最多缓存的报文数,超过的丢弃
+const maxPendingPackets = 16
+
+// udpSession 一个客户端地址对应的UDP会话
+type udpSession struct {
+	client *net.UDPAddr
+	t      *tracked
+	header []byte // 每个报文前面的PROXY v2头
+
+	mu      sync.Mutex
+	conn    net.Conn // 到目标的连接,连接目标期间为nil
+	b       *backend
+	pending [][]byte // 连接目标期间收到的报文
+	closed  bool
+}
+
+// close 关闭会话;还在连接目标时由连接协程连上后关闭
+func (s *udpSession) close() {
+	s.mu.Lock()
+	s.closed = true
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// forward 把客户端的报文发给目标,buf用于拼接PROXY头,返回buf以便复用
+func (s *udpSession) forward(conn net.Conn, data, buf []byte) []byte {
+	if !s.t.allowIn(len(data)) {
+		return buf
+	}
+	out := data
+	if s.header != nil {
+		buf = append(append(buf[:0], s.header...), data...)
+		out = buf
+	}
+	if _, err := conn.Write(out); err != nil {
+		log.Printf("UDP Forward err : %v\r\n", err)
+		return buf
+	}
+	s.t.tapIn(data)
+	s.t.addIn(int64(len(data)))
+	return buf
+}
+
+// udpTable 每个UDP监听自己的会话表
+type udpTable struct {
+	conn     *net.UDPConn
+	lb       *balancer
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	max      int
+	out      []byte // 加PROXY头时拼接报文用,只在读取协程里使用
+	denied   deniedLog
+}
+
+func newUDPTable(conn *net.UDPConn, lb *balancer, max int) *udpTable {
+	if max <= 0 {
+		max = defaultMaxUDPSessions
+	}
+	return &udpTable{conn: conn, lb: lb, sessions: make(map[string]*udpSession), max: max}
+}
+
+func (tb *udpTable) get(key string) *udpSession {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.sessions[key]
+}
+
+// add 加入新会话;会话数达到上限时关闭最久没有活动的会话腾出位置
+func (tb *udpTable) add(key string, s *udpSession) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if len(tb.sessions) >= tb.max {
+		var oldest *udpSession
+		for _, v := range tb.sessions {
+			if oldest == nil || v.t.lastActive() < oldest.t.lastActive() {
+				oldest = v
+			}
+		}
+		if oldest != nil {
+			log.Printf("UDP session limit %d reached, evict %s\r\n", tb.max, oldest.client)
+			delete(tb.sessions, oldest.client.String())
+			oldest.t.setReason(closeEvicted)
+			oldest.close()
+		}
+	}
+	tb.sessions[key] = s
+}
+
+func (tb *udpTable) remove(key string, s *udpSession) {
+	tb.mu.Lock()
+	if tb.sessions[key] == s {
+		delete(tb.sessions, key)
+	}
+	tb.mu.Unlock()
+}
+
+// evictIdle 关闭空闲超过timeout的会话
+func (tb *udpTable) evictIdle(timeout time.Duration) {
+	deadline := time.Now().Add(-timeout).UnixNano()
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	for key, s := range tb.sessions {
+		if s.t.lastActive() < deadline {
+			delete(tb.sessions, key)
+			s.t.setReason(closeIdle)
+			s.close()
+		}
+	}
+}
+
+func (tb *udpTable) list() []ConnInfo {
+	tb.mu.Lock()
+	list := make([]ConnInfo, 0, len(tb.sessions))
+	for _, s := range tb.sessions {
+		list = append(list, s.t.info())
+	}
+	tb.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// --------------------- UDP 代理实现 ---------------------
+func (r *rule) startUDP(listenAddr string, lb *balancer) error {
+	srcAddr, err := net.ResolveUDPAddr("udp"+r.family, listenAddr)
+	if err != nil {
+		log.Printf("UDP proxy %s -> %s err:%v\r\n", listenAddr, lb, err)
+		return err
+	}
+	listener, err := net.ListenUDP("udp"+r.family, srcAddr)
+	if err != nil {
+		log.Printf("UDP proxy %s -> %s err:%v\r\n", listenAddr, lb, err)
+		return err
+	}
+
+	log.Printf("UDP proxy  %s -> %s ok\r\n", listenAddr, lb)
+	tb := newUDPTable(listener, lb, r.cfg.MaxSessions)
+	r.udpConns = append(r.udpConns, listener)
+	r.udps = append(r.udps, tb)
+
+	go r.evictUDPSessions(tb)
+	go func() {
+		for {
+			// 每个报文单独从池里取缓冲区
+			bufp := udpBufPool.Get().(*[]byte)
+			n, clientAddr, err := listener.ReadFromUDP(*bufp)
+			if err != nil {
+				udpBufPool.Put(bufp)
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("UDP read err: %v\r\n", err)
+				}
+				break
+			}
+			r.handleUDPPacket(tb, clientAddr, (*bufp)[:n])
+			udpBufPool.Put(bufp)
+		}
+	}()
+	return nil
+}
+
+// evictUDPSessions 定期清理空闲会话,规则停止时退出;
+// 每轮重新读取超时设置,修改全局设置后不用重启规则
+func (r *rule) evictUDPSessions(tb *udpTable) {
+	for {
+		timeout := r.udpTimeout()
+		interval := timeout / 4
+		if timeout <= 0 {
+			interval = time.Minute // 不超时,只定期检查设置是否变化
+		}
+		select {
+		case <-r.done:
+			return
+		case <-time.After(interval):
+			if timeout > 0 {
+				tb.evictIdle(timeout)
+			}
+		}
+	}
+}
+
+func (r *rule) handleUDPPacket(tb *udpTable, clientAddr *net.UDPAddr, data []byte) {
+	key := clientAddr.String()
+	s := tb.get(key)
+	if s == nil {
+		// 新客户端先检查IP,被拒绝的客户端没有会话,之后的报文会再次检查
+		if !r.clientAllowed(clientAddr) {
+			if tb.denied.shouldLog(clientAddr.IP.String()) {
+				log.Printf("UDP proxy %s denied client %s\r\n", tb.conn.LocalAddr(), clientAddr)
+			}
+			return
+		}
+		// 新客户端,在单独的协程里连接目标,不阻塞读取循环
+		t := r.open(clientAddr, "", nil)
+		if t == nil {
+			return
+		}
+		s = &udpSession{client: clientAddr, t: t}
+		tb.add(key, s)
+		go r.connectUDPSession(tb, key, s)
+	}
+	s.mu.Lock()
+	conn := s.conn
+	if conn == nil {
+		// 还在连接目标,报文复制一份排队,读取缓冲区马上会被复用
+		if !s.closed && len(s.pending) < maxPendingPackets {
+			s.pending = append(s.pending, append([]byte(nil), data...))
+		}
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	tb.out = s.forward(conn, data, tb.out)
+}
+
+// connectUDPSession 连接目标,发出排队的报文后开始回传响应
+func (r *rule) connectUDPSession(tb *udpTable, key string, s *udpSession) {
+	if r.cfg.SendProxy != "" {
+		s.header = r.proxyHeader("udp", s.client, udpLocalAddr(tb.conn, s.client))
+	}
+	targetConn, b, err := r.dial("udp", tb.lb, s.client, nil)
+	if err != nil {
+		s.t.setTarget(tb.lb.String())
+		s.t.setReason(closeDial)
+		tb.remove(key, s)
+		r.close(s.t)
+		return
+	}
+	s.mu.Lock()
+	closed := s.closed
+	if !closed {
+		closed = !r.attach(s.t, targetConn, b.addr)
+	}
+	if closed {
+		s.mu.Unlock()
+		b.done()
+		targetConn.Close()
+		tb.remove(key, s)
+		r.close(s.t)
+		return
+	}
+	// 持锁发出排队的报文后再设置conn,读取循环在这期间等锁,
+	// 之后的报文不会先于排队的报文到达目标,也只有读取循环会调用forward
+	var buf []byte
+	for _, p := range s.pending {
+		buf = s.forward(targetConn, p, buf)
+	}
+	s.pending = nil
+	s.conn, s.b = targetConn, b
+	s.mu.Unlock()
+	r.udpSessionLoop(tb, key, s)
+}
+
+// udpLocalAddr 客户端报文的目标地址,用于PROXY头。监听0.0.0.0或::时从socket上
+// 看不到客户端发往哪个IP,用系统回复这个客户端时选择的源地址代替:单网卡时就是
+// 客户端发往的地址,多网卡时可能不同。查不到时返回nil,PROXY头不带地址
+func udpLocalAddr(conn *net.UDPConn, client *net.UDPAddr) net.Addr {
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || !local.IP.IsUnspecified() {
+		return conn.LocalAddr()
+	}
+	// 连接UDP只查路由,不发送数据
+	c, err := net.DialUDP("udp", nil, client)
+	if err != nil {
+		log.Printf("UDP resolve local address for %s err: %v\r\n", client, err)
+		return nil
+	}
+	defer c.Close()
+	return &net.UDPAddr{IP: c.LocalAddr().(*net.UDPAddr).IP, Port: local.Port}
+}
+
+// udpSessionLoop 把目标的响应回传给客户端,会话被关闭时退出
+func (r *rule) udpSessionLoop(tb *udpTable, key string, s *udpSession) {
+	defer r.close(s.t)
+	defer tb.remove(key, s)
+	defer s.b.done()
+	defer s.conn.Close()
+
+	bufp := udpBufPool.Get().(*[]byte)
+	defer udpBufPool.Put(bufp)
+	for {
+		// 等待响应并回传
+		n, err := s.conn.Read(*bufp)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("UDP read err: %v\r\n", err)
+				s.t.setReason(relayReason(nil, err))
+			}
+			return
+		}
+		if !s.t.allowOut(n) {
+			continue
+		}
+		if _, err := tb.conn.WriteToUDP((*bufp)[:n], s.client); err != nil {
+			log.Printf("UDP write err: %v\r\n", err)
+			continue
+		}
+		s.t.tapOut((*bufp)[:n])
+		s.t.addOut(int64(n))
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dosgo/wslPortForward/config"
+)
+
+// udpEcho 启动一个把报文原样发回的UDP服务
+func udpEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return echo
+}
+
+// TestUDPFirstPackets 连接目标期间收到的报文排队,连上后按顺序发出
+func TestUDPFirstPackets(t *testing.T) {
+	echo := udpEcho(t)
+	cfg := &config.ProxyConfig{ID: "udp", Protocol: "udp"}
+	r := newTestRule(cfg)
+	if err := r.startUDP("127.0.0.1:0", newBalancer("", []string{echo.LocalAddr().String()})); err != nil {
+		t.Fatal(err)
+	}
+	defer r.stop()
+
+	client, err := net.DialUDP("udp", nil, r.udpConns[0].LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	want := []string{"one", "two", "three"}
+	for _, m := range want {
+		if _, err := client.Write([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	for _, m := range want {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != m {
+			t.Fatalf("got %q, want %q", buf[:n], m)
+		}
+	}
+	if got := r.stats.udpSessions.Load(); got != 1 {
+		t.Fatalf("sessions = %d, want 1", got)
+	}
+}
+
+// TestUDPPacketOrder 连接目标前后连续发送的报文到达目标的顺序不变
+func TestUDPPacketOrder(t *testing.T) {
+	echo := udpEcho(t)
+	r := newTestRule(&config.ProxyConfig{ID: "udp", Protocol: "udp"})
+	if err := r.startUDP("127.0.0.1:0", newBalancer("", []string{echo.LocalAddr().String()})); err != nil {
+		t.Fatal(err)
+	}
+	defer r.stop()
+
+	client, err := net.DialUDP("udp", nil, r.udpConns[0].LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	const count = 200
+	go func() {
+		for i := 0; i < count; i++ {
+			client.Write([]byte(strconv.Itoa(i)))
+			if i%10 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	last := -1
+	for last < count-1 {
+		n, err := client.Read(buf)
+		if err != nil {
+			break // 排队满时丢弃的报文不会回来
+		}
+		i, _ := strconv.Atoi(string(buf[:n]))
+		if i <= last {
+			t.Fatalf("packet %d arrived after %d", i, last)
+		}
+		last = i
+	}
+	if last < 0 {
+		t.Fatal("no packets echoed")
+	}
+}
+
+// TestUDPLocalAddr 监听通配地址时PROXY头的目标不能是0.0.0.0
+func TestUDPLocalAddr(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	addr, ok := udpLocalAddr(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}).(*net.UDPAddr)
+	if !ok || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port != port {
+		t.Fatalf("local addr = %v, want 127.0.0.1:%d", addr, port)
+	}
+	hdr := proxyHeaderV2("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, addr)
+	if hdr[13] != 0x12 {
+		t.Fatalf("family byte = %#x, want AF_INET|DGRAM", hdr[13])
+	}
+}